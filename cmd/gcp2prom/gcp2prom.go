@@ -266,8 +266,12 @@ func main() {
 	monClient := mon.MustMonitoringClient(nil)
 	ch, runner := mon2prom.MetricFetcher(monClient)
 	count := 0
-	for _, pref := range config.MustLoadConfig("").GcpPrefixes() {
-		for md := range monClient.StreamMetricDescs(nil, proj, pref) {
+	conf := config.MustLoadConfig("")
+	fields := conf.RequiredDescriptorFields()
+	for _, pref := range conf.GcpPrefixes() {
+		for md := range monClient.StreamMetricDescs(
+			nil, proj, pref, fields...,
+		) {
 			if export(proj, monClient, md, ch) {
 				count++
 			}
@@ -11,6 +11,7 @@ import (
 
 	"github.com/Unity-Technologies/go-lager-internal"
 	"github.com/Unity-Technologies/tools-gcp-internal/conn"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/monitoring/v3"
 )
 
@@ -238,12 +239,16 @@ func (m Client) GetLatestTimeSeries(
 	}
 }
 
+// Streams the MetricDescriptors whose type starts with 'prefix'.  If any
+// 'fields' are given (such as from a gcp2prom Configuration's
+// RequiredDescriptorFields()), then only those fields are requested.
+//
 func (m Client) StreamMetricDescs(
-	ctx context.Context, projectID, prefix string,
+	ctx context.Context, projectID, prefix string, fields ...string,
 ) <-chan *monitoring.MetricDescriptor {
 	ch := make(chan *monitoring.MetricDescriptor, 1)
 	go func() {
-		m.GetMetricDescs(ctx, ch, projectID, prefix)
+		m.GetMetricDescs(ctx, ch, projectID, prefix, fields...)
 		close(ch)
 	}()
 	return ch
@@ -254,6 +259,7 @@ func (m Client) GetMetricDescs(
 	ch chan<- *monitoring.MetricDescriptor,
 	projectID string,
 	prefix string,
+	fields ...string,
 ) {
 	if nil == ctx {
 		defer conn.Timeout(
@@ -266,6 +272,11 @@ func (m Client) GetMetricDescs(
 			fmt.Sprintf(`metric.type = starts_with("%s")`, prefix),
 		)
 	}
+	if 0 < len(fields) {
+		lister = lister.Fields(googleapi.Field(
+			"nextPageToken,metricDescriptors(" +
+				strings.Join(fields, ",") + ")"))
+	}
 	first := isFirst
 	last := !isLast
 	for !last {
@@ -1,9 +1,12 @@
 package mon2prom
 
 import (
+	"math"
 	"testing"
 
 	"github.com/Unity-Technologies/go-tutl-internal"
+	"github.com/Unity-Technologies/tools-gcp-internal/mon"
+	"github.com/Unity-Technologies/tools-gcp-internal/mon2prom/label"
 	"github.com/Unity-Technologies/tools-gcp-internal/mon2prom/value"
 	sd "google.golang.org/api/monitoring/v3" // "StackDriver"
 )
@@ -140,3 +143,187 @@ func TestCombineBoundaries(t *testing.T) {
 		}
 	}
 }
+
+func TestParseBucketOptions(t *testing.T) {
+	u := tutl.New(t)
+
+	milli := func(f float64) float64 { return f / 1000.0 }
+	explicit := &sd.BucketOptions{ExplicitBuckets: &sd.Explicit{
+		Bounds: []float64{1000, 2000, 4000},
+	}}
+	for pass := 1; pass <= 2; pass++ {
+		count, first, next := parseBucketOptions("", explicit, milli)
+		u.Is(3, count, u.S("explicit count, pass ", pass))
+		u.Is(1.0, first, u.S("explicit first, pass ", pass))
+		u.Is(2.0, next(first), u.S("explicit second, pass ", pass))
+		u.Is(4.0, next(2.0), u.S("explicit third, pass ", pass))
+	}
+	u.Is([]float64{1000, 2000, 4000}, explicit.ExplicitBuckets.Bounds,
+		"explicit bounds not scaled in place")
+
+	linear := &sd.BucketOptions{LinearBuckets: &sd.Linear{
+		NumFiniteBuckets: 3, Offset: 500, Width: 1000,
+	}}
+	count, first, next := parseBucketOptions("", linear, milli)
+	u.Is(4, count, "linear count")
+	u.Is(0.5, first, "linear first scaled")
+	u.Is(1.5, next(first), "linear step scaled")
+	u.Is(2.5, next(1.5), "linear third scaled")
+	_, first, next = parseBucketOptions("", linear, nil)
+	u.Is(1500.0, next(first), "linear step unscaled")
+}
+
+func TestResampleDistribution(t *testing.T) {
+	u := tutl.New(t)
+
+	ones := []int64{1, 1, 1, 1, 1, 1, 1, 1, 1}
+	explicit := &sd.Distribution{
+		BucketOptions: &sd.BucketOptions{ExplicitBuckets: &sd.Explicit{
+			Bounds: []float64{1, 2, 3, 4, 5, 6, 7, 8},
+		}},
+		BucketCounts: ones,
+		Count:        9,
+	}
+
+	// MinRatio combining //
+
+	bounds, counts, dropped := ResampleDistribution(
+		explicit, 1, 0.0, 2.0, 0.0, 0, nil)
+	u.Is(false, dropped, "ratio dropped")
+	u.Is([]float64{1, 2, 4, 8}, bounds, "ratio bounds")
+	u.Is([]uint64{1, 1, 2, 4, 1}, counts, "ratio counts")
+
+	// MaxBuckets drop //
+
+	bounds, counts, dropped = ResampleDistribution(
+		explicit, 1, 0.0, 2.0, 0.0, 4, nil)
+	u.Is(false, dropped, "max buckets at limit")
+	bounds, counts, dropped = ResampleDistribution(
+		explicit, 1, 0.0, 2.0, 0.0, 3, nil)
+	u.Is(true, dropped, "max buckets exceeded")
+	u.Is(4, len(bounds), "dropped still returns bounds")
+	u.Is(5, len(counts), "dropped still returns counts")
+
+	// MinBound/MaxBound clipping //
+
+	bounds, counts, dropped = ResampleDistribution(&sd.Distribution{
+		BucketOptions: &sd.BucketOptions{ExponentialBuckets: &sd.Exponential{
+			NumFiniteBuckets: 6,
+			Scale:            1.0,
+			GrowthFactor:     2.0,
+		}},
+		BucketCounts: []int64{1, 2, 3, 4, 5, 6, 7, 8},
+		Count:        36,
+	}, 1, 4.0, 0.0, 16.0, 0, nil)
+	u.Is(false, dropped, "clip dropped")
+	u.Is([]float64{4, 8, 16}, bounds, "clip bounds")
+	u.Is([]uint64{6, 4, 5, 21}, counts, "clip counts")
+
+	// Scaling applied to bounds //
+
+	milli := func(f float64) float64 { return f / 1000.0 }
+	bounds, counts, dropped = ResampleDistribution(&sd.Distribution{
+		BucketOptions: &sd.BucketOptions{LinearBuckets: &sd.Linear{
+			NumFiniteBuckets: 3,
+			Offset:           0.0,
+			Width:            1000.0,
+		}},
+		BucketCounts: []int64{1, 2, 3, 4, 5},
+		Count:        15,
+	}, 10, 0.0, 0.0, 0.0, 0, milli)
+	u.Is(false, dropped, "scaled dropped")
+	u.Is([]float64{0, 1, 2, 3}, bounds, "scaled bounds")
+	u.Is([]uint64{1, 2, 3, 4, 5}, counts, "scaled counts")
+
+	bounds, _, _ = ResampleDistribution(explicit, 1, 0.0, 2.0, 0.0, 0, milli)
+	u.Is([]float64{0.001, 0.002, 0.004, 0.008}, bounds, "scaled explicit")
+	u.Is([]float64{1, 2, 3, 4, 5, 6, 7, 8},
+		explicit.BucketOptions.ExplicitBuckets.Bounds, "input not modified")
+
+	// Unusable input //
+
+	bounds, counts, dropped = ResampleDistribution(nil, 1, 0, 0, 0, 0, nil)
+	u.Is(true, dropped, "nil dist dropped")
+	u.Is(0, len(bounds), "nil dist bounds")
+	u.Is(0, len(counts), "nil dist counts")
+}
+
+func TestLayoutBounds(t *testing.T) {
+	u := tutl.New(t)
+
+	layout := []float64{0.01, 0.1, 1, 10}
+	convert := func(subBuckets []int, dist *sd.Distribution) []uint64 {
+		hist := value.RwHistogram{}
+		hist.Convert(subBuckets, dist)
+		return hist.BucketHits
+	}
+
+	// Exponential buckets in milliseconds: 1, 10, ..., 100000 ms
+	milli := func(f float64) float64 { return f / 1000.0 }
+	expo := &sd.Distribution{
+		BucketOptions: &sd.BucketOptions{ExponentialBuckets: &sd.Exponential{
+			NumFiniteBuckets: 5,
+			Scale:            1.0,
+			GrowthFactor:     10.0,
+		}},
+		BucketCounts: []int64{1, 2, 3, 4, 5, 6, 7},
+		Count:        28,
+	}
+	bounds, subBuckets, ok := layoutBounds("expo", expo.BucketOptions,
+		milli, layout)
+	u.Is(true, ok, "expo parsed")
+	u.Is(layout, bounds, "expo uses layout bounds")
+	// GCP bounds 0.001, 0.01, 0.1, 1, 10, 100 s; 100 s goes to +Inf:
+	u.Is([]int{2, 1, 1, 1}, subBuckets, "expo sub-buckets")
+	u.Is([]uint64{3, 3, 4, 5, 13}, convert(subBuckets, expo), "expo counts")
+
+	// Explicit buckets in seconds that skip some layout buckets:
+	explicit := &sd.Distribution{
+		BucketOptions: &sd.BucketOptions{ExplicitBuckets: &sd.Explicit{
+			Bounds: []float64{0.5, 0.75, 50},
+		}},
+		BucketCounts: []int64{1, 2, 3, 4},
+		Count:        10,
+	}
+	bounds, subBuckets, ok = layoutBounds("explicit", explicit.BucketOptions,
+		nil, layout)
+	u.Is(true, ok, "explicit parsed")
+	u.Is(layout, bounds, "explicit uses same layout bounds")
+	u.Is([]int{0, 0, 2, 0}, subBuckets, "explicit sub-buckets")
+	u.Is([]uint64{0, 0, 3, 0, 7}, convert(subBuckets, explicit),
+		"explicit counts")
+
+	bounds[0] = 99
+	u.Is(0.01, layout[0], "layout not shared with returned bounds")
+
+	_, _, ok = layoutBounds("bad", &sd.BucketOptions{}, nil, layout)
+	u.Is(false, ok, "unparsable buckets")
+}
+
+func TestRoundExported(t *testing.T) {
+	u := tutl.New(t)
+
+	toSecs := func(f float64) float64 { return f / 1e9 }
+	round := func(f float64) float64 { return math.Round(f*1000) / 1000 }
+	m := make(map[label.RuneList]value.Metric)
+	var ls label.Set
+	ts := &sd.TimeSeries{Metric: &sd.Metric{}, Resource: &sd.MonitoredResource{}}
+	ns := 400000.0
+	for i := 0; i < 3; i++ {
+		value.Populate(m, mon.KDelta, mon.TFloat, toSecs, &ls, nil, ts,
+			&sd.Point{
+				Interval: &sd.TimeInterval{EndTime: "2026-10-14T00:00:00Z"},
+				Value:    &sd.TypedValue{DoubleValue: &ns},
+			})
+	}
+	if !u.Is(1, len(m), "one metric") {
+		return
+	}
+	for rl, v := range m {
+		metric := v.Export(mon.KDelta, mon.TFloat, &ls, rl, nil)
+		u.Is(0.0012, math.Round(metric.Counter.GetValue()*1e6)/1e6,
+			"increments accumulated unrounded")
+		value.Round(&metric, round)
+		u.Is(0.001, metric.Counter.GetValue(), "exported value rounded")
+	}
+}
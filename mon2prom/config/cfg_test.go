@@ -1,14 +1,21 @@
 package config
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/Unity-Technologies/go-lager-internal"
 	"github.com/Unity-Technologies/go-tutl-internal"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	sd "google.golang.org/api/monitoring/v3"
 )
 
@@ -166,3 +173,824 @@ func TestMatcher(t *testing.T) {
 		u.Is("[client_country proxy_continent]", mm.OmitLabels(), "omit labels")
 	}
 }
+
+func suffixRule(stop bool, pairs ...string) *SuffixConf {
+	s := &SuffixConf{Replace: make(map[string]string), Stop: stop}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		s.Replace[pairs[i]] = pairs[i+1]
+	}
+	s.keys = longestKeysFirst(s.Replace)
+	return s
+}
+
+func TestSuffixStop(t *testing.T) {
+	var u = tutl.New(t)
+
+	cfg := Configuration{
+		System:    "gcp",
+		Subsystem: map[string]string{"example.com/svc/": "svc"},
+		Suffix: []*SuffixConf{
+			suffixRule(true, "_count", "_total"),
+			suffixRule(false, "_total", "_sum", "_size", "_bytes"),
+		},
+	}
+	md := &sd.MetricDescriptor{
+		Type: "example.com/svc/request_count", MetricKind: "DELTA",
+		ValueType: "INT64", Unit: "1",
+	}
+
+	mm := cfg.MatchMetric(md)
+	u.Is("/request_total", mm.Name, "terminal rule skips later rules")
+
+	md.Type = "example.com/svc/request_size"
+	mm = cfg.MatchMetric(md)
+	u.Is("/request_bytes", mm.Name, "no replacement so no stop")
+
+	cfg.Suffix[0].Stop = false
+	md.Type = "example.com/svc/request_count"
+	mm = cfg.MatchMetric(md)
+	u.Is("/request_sum", mm.Name, "non-terminal rule lets later rules apply")
+}
+
+func TestDrop(t *testing.T) {
+	var u = tutl.New(t)
+
+	cfg := Configuration{
+		System:    "gcp",
+		Subsystem: map[string]string{"example.com/svc/": "svc"},
+		Suffix:    []*SuffixConf{suffixRule(false, "_count", "_total")},
+		OmitLabel: []OmitLabelConf{{
+			For: Selector{Suffix: []string{"/noisy_total"}}, Labels: []string{"x"},
+		}},
+		Drop: []Selector{{Suffix: []string{"/noisy_total"}}},
+	}
+	md := &sd.MetricDescriptor{
+		Type: "example.com/svc/request_count", MetricKind: "DELTA",
+		ValueType: "INT64", Unit: "1",
+	}
+	mm := cfg.MatchMetric(md)
+	if u.IsNot(nil, mm, "metric under prefix exported") {
+		u.Is("gcp_svc_request_total", mm.PromName(), "exported name")
+	}
+
+	md.Type = "example.com/svc/noisy_count"
+	u.Is(nil, cfg.MatchMetric(md), "drop uses computed name")
+
+	md.Type = "example.com/svc/noisy"
+	u.IsNot(nil, cfg.MatchMetric(md), "drop compares final suffix only")
+
+	cfg.Drop = []Selector{{Prefix: []string{"example.com/svc/"}, Only: "G"}}
+	md.Type = "example.com/svc/request_count"
+	u.IsNot(nil, cfg.MatchMetric(md), "delta not dropped by gauge rule")
+	md.MetricKind = "GAUGE"
+	u.Is(nil, cfg.MatchMetric(md), "gauge dropped")
+}
+
+func TestExportedNames(t *testing.T) {
+	var u = tutl.New(t)
+
+	cfg := Configuration{
+		System:    "gcp",
+		Subsystem: map[string]string{"example.com/svc/": "svc"},
+		Suffix:    []*SuffixConf{suffixRule(false, "_count", "_total")},
+		Drop:      []Selector{{Suffix: []string{"/noisy_total"}}},
+	}
+	md := func(typ string) *sd.MetricDescriptor {
+		return &sd.MetricDescriptor{
+			Type: typ, MetricKind: "DELTA", ValueType: "INT64", Unit: "1",
+		}
+	}
+	mds := []*sd.MetricDescriptor{
+		md("example.com/svc/request_count"),
+		md("example.com/svc/noisy_count"),
+		md("other.com/svc/request_count"),
+		md("example.com/svc/error_count"),
+		md("example.com/svc/request_total"),
+	}
+	u.Is([]string{"gcp_svc_error_total", "gcp_svc_request_total"},
+		cfg.ExportedNames(mds), "exported names")
+	u.Is(0, len(cfg.ExportedNames(nil)), "no descriptors")
+	u.Is(0, len(cfg.ExportedNames(mds[1:3])), "dropped and unmatched")
+}
+
+func TestUnmatchedPrefixes(t *testing.T) {
+	var u = tutl.New(t)
+
+	cfg := Configuration{
+		System: "gcp",
+		Subsystem: map[string]string{
+			"example.com/svc/":     "svc",
+			"example.com/svc/sub/": "sub",
+		},
+		Drop: []Selector{{Suffix: []string{"/noisy_count"}}},
+	}
+	md := func(typ string) *sd.MetricDescriptor {
+		return &sd.MetricDescriptor{
+			Type: typ, MetricKind: "DELTA", ValueType: "INT64", Unit: "1",
+		}
+	}
+	mds := []*sd.MetricDescriptor{
+		md("example.com/svc/request_count"),
+		md("example.com/svc/noisy_count"),
+		md("example.com/svc/sub/deep/error_count"),
+		md("example.com/other/request_count"),
+		md("new.com/api/request_count"),
+		md("example.com/other/error_count"),
+		md("new.com/api/v2/latency"),
+		md("example.com/other/bytes"),
+		md("bare_metric"),
+	}
+	u.Is([]PrefixCount{
+		{"bare_metric", 1},
+		{"example.com/other/", 3},
+		{"new.com/api/", 1},
+		{"new.com/api/v2/", 1},
+	}, cfg.UnmatchedPrefixes(mds), "unmatched prefixes")
+	u.Is(0, len(cfg.UnmatchedPrefixes(mds[:3])), "all matched or dropped")
+	u.Is(0, len(cfg.UnmatchedPrefixes(nil)), "no descriptors")
+}
+
+// sameConfig() returns whether 'a' and 'b' are the same, ignoring the order
+// of same-length Suffix keys (which follows the order of map iteration).
+//
+func sameConfig(a, b Configuration) bool {
+	if len(a.Suffix) != len(b.Suffix) {
+		return false
+	}
+	unordered := func(c Configuration) Configuration {
+		sufs := make([]*SuffixConf, len(c.Suffix))
+		for i, suf := range c.Suffix {
+			cp := *suf
+			cp.keys = append([]string(nil), suf.keys...)
+			sort.Strings(cp.keys)
+			sufs[i] = &cp
+		}
+		c.Suffix = sufs
+		return c
+	}
+	return reflect.DeepEqual(unordered(a), unordered(b))
+}
+
+func TestLoadConfigFrom(t *testing.T) {
+	var u = tutl.New(t)
+
+	path := "../../gcp2prom.yaml"
+	fromFile, err := LoadConfig(path)
+	u.Is(nil, err, "load from file")
+	embedded, err := os.ReadFile(path)
+	u.Is(nil, err, "read file")
+
+	fromBytes, err := LoadConfigFrom(bytes.NewReader(embedded), "embedded")
+	u.Is(nil, err, "load from byte slice")
+	u.Is(true, sameConfig(fromFile, fromBytes), "bytes same as file")
+	u.Is("/100", fromBytes.Unit["%"], "units comma-expanded")
+
+	fromStr, err := LoadConfigFrom(strings.NewReader(string(embedded)), "")
+	u.Is(nil, err, "load from string")
+	u.Is(true, sameConfig(fromFile, fromStr), "string same as file")
+
+	again, err := LoadConfigFrom(strings.NewReader("bogus"), "embedded")
+	u.Is(nil, err, "cached by name")
+	u.Is(true, reflect.DeepEqual(fromBytes, again), "cached config returned")
+
+	_, err = LoadConfigFrom(strings.NewReader("system: gcp\nbogus: 1\n"), "")
+	u.Like(err, "strict decoding", "Invalid yaml in <reader>:", "bogus")
+	_, err = LoadConfigFrom(strings.NewReader("bogus: 1\n"), "remote")
+	u.Like(err, "error names source", "Invalid yaml in remote")
+}
+
+func TestCompositeUnits(t *testing.T) {
+	var u = tutl.New(t)
+
+	cfg := Configuration{
+		System:    "gcp",
+		Subsystem: map[string]string{"example.com/svc/": "svc"},
+		Unit:      map[string]string{"By": "*8", "ms": "/1000", "GBy.s": "/100"},
+	}
+	scaler := func(unit string) (ScalingFunc, string) {
+		mm := cfg.MatchMetric(&sd.MetricDescriptor{
+			Type: "example.com/svc/traffic", MetricKind: "GAUGE",
+			ValueType: "DOUBLE", Unit: unit,
+		})
+		u.Is(unit, mm.Unit, "composite unit kept in Unit")
+		return mm.Scaler()
+	}
+
+	f, key := scaler("By/s")
+	if u.IsNot(nil, f, "By/s scaled") {
+		u.Is(80.0, f(10.0), "By/s -> bit/s")
+		u.Is("(*8)/()", key, "By/s scale name")
+	}
+	f, key = scaler("By/ms")
+	if u.IsNot(nil, f, "By/ms scaled") {
+		u.Is(80000.0, f(10.0), "By/ms -> bit/s")
+		u.Is("(*8)/(/1000)", key, "By/ms scale name")
+	}
+	f, _ = scaler("1/ms")
+	if u.IsNot(nil, f, "1/ms scaled") {
+		u.Is(5000.0, f(5.0), "1/ms -> 1/s")
+	}
+
+	f, key = scaler("1/s")
+	u.Is(nil, f, "no-op composite")
+	u.Is("", key, "no-op composite name")
+	f, key = scaler("GBy.s")
+	if u.IsNot(nil, f, "whole unit scaled") {
+		u.Is(0.5, f(50.0), "whole unit scaling unchanged")
+		u.Is("/100", key, "whole unit scale name")
+	}
+	f, _ = scaler("s")
+	u.Is(nil, f, "unlisted simple unit")
+}
+
+// Returns the value of each configLoadTime gauge, keyed by path label.
+func loadTimes() map[string]float64 {
+	ch := make(chan prometheus.Metric, 100)
+	configLoadTime.Collect(ch)
+	close(ch)
+	times := make(map[string]float64)
+	for m := range ch {
+		var d dto.Metric
+		m.Write(&d)
+		times[d.Label[0].GetValue()] = d.Gauge.GetValue()
+	}
+	return times
+}
+
+func TestConfigLoadTime(t *testing.T) {
+	var u = tutl.New(t)
+
+	path := t.TempDir() + "/gcp2prom.yaml"
+	err := os.WriteFile(path, []byte("system: gcp\n"), 0o644)
+	u.Is(nil, err, "write config")
+
+	before := float64(time.Now().UnixNano()) / 1e9
+	_, err = LoadConfig(path)
+	u.Is(nil, err, "load config")
+	loaded, ok := loadTimes()[path]
+	u.Is(true, ok, "gauge set for path")
+	u.Is(true, before <= loaded, "load time not before load")
+	u.Is(true, loaded <= float64(time.Now().UnixNano())/1e9,
+		"load time not future")
+
+	_, err = LoadConfigFrom(strings.NewReader("bogus: 1\n"), "bad-config")
+	u.IsNot(nil, err, "bad config fails")
+	_, ok = loadTimes()["bad-config"]
+	u.Is(false, ok, "failed load sets no gauge")
+	u.Is(loaded, loadTimes()[path], "failed load leaves other gauges")
+}
+
+func TestNameStyle(t *testing.T) {
+	var u = tutl.New(t)
+
+	cfg := Configuration{
+		System:    "gcp",
+		Subsystem: map[string]string{"example.com/My-Svc./": "My-Svc."},
+	}
+	name := func(style, metric string) string {
+		cfg.NameStyle = style
+		mm := cfg.MatchMetric(&sd.MetricDescriptor{
+			Type: "example.com/My-Svc./" + metric, MetricKind: "GAUGE",
+			ValueType: "INT64", Unit: "1",
+		})
+		return mm.PromName()
+	}
+	for _, tc := range []struct{ style, metric, want string }{
+		{"", "req.Latency-ms", "gcp_My_Svc__req_Latency_ms"},
+		{"raw", "Bytes..sent--Total", "gcp_My_Svc__Bytes_sent_Total"},
+		{"raw", "a_-_b.", "gcp_My_Svc__a___b_"},
+		{"collapse_underscores", "req.Latency-ms", "gcp_My_Svc_req_Latency_ms"},
+		{"collapse_underscores", "_a_-_b.", "gcp_My_Svc_a_b"},
+		{"collapse_underscores", "--", "gcp_My_Svc__"},
+		{"lowercase", "Bytes..sent--Total", "gcp_my_svc_bytes_sent_total"},
+		{"lowercase", "a_-_B.", "gcp_my_svc_a_b"},
+	} {
+		u.Is(tc.want, name(tc.style, tc.metric), tc.style+" "+tc.metric)
+	}
+
+	_, err := LoadConfigFrom(
+		strings.NewReader("system: gcp\nnamestyle: lowercase\n"), "")
+	u.Is(nil, err, "valid namestyle")
+	_, err = LoadConfigFrom(
+		strings.NewReader("system: gcp\nnamestyle: Lower\n"), "styled")
+	u.Like(err, "invalid namestyle",
+		"*invalid namestyle", `"Lower"`, "styled", "collapse_underscores")
+	cfg.NameStyle = "Lower"
+	u.Like(cfg.Validate(), "built with invalid namestyle",
+		"*invalid namestyle", `"Lower"`)
+}
+
+func TestResourceLabels(t *testing.T) {
+	var u = tutl.New(t)
+
+	cfg := Configuration{
+		System: "gcp",
+		Subsystem: map[string]string{
+			"example.com/vm/": "vm", "example.com/lb/": "lb",
+			"example.com/db/": "db",
+		},
+		ResourceLabel: []ResourceLabelConf{{
+			For:            Selector{Prefix: []string{"example.com/vm/"}},
+			ResourceLabels: []string{"zone", "instance_id"},
+		}, {
+			For:            Selector{Prefix: []string{"example.com/lb/"}},
+			ResourceLabels: []string{},
+		}},
+		OmitLabel: []OmitLabelConf{{
+			For:    Selector{Prefix: []string{"example.com/vm/"}},
+			Labels: []string{"instance_id"},
+		}},
+	}
+	matcher := func(typ string) *MetricMatcher {
+		return cfg.MatchMetric(&sd.MetricDescriptor{
+			Type: typ, MetricKind: "GAUGE", ValueType: "INT64", Unit: "1",
+		})
+	}
+
+	mm := matcher("example.com/vm/cpu")
+	u.Is([]string{"zone", "instance_id"}, mm.ResourceLabels(),
+		"rule promotes zone and instance_id")
+	u.Is([]string{"instance_id"}, mm.OmitLabels(), "omit rules still apply")
+
+	mm = matcher("example.com/lb/requests")
+	u.IsNot(nil, mm.ResourceLabels(), "rule promoting none is not nil")
+	u.Is(0, len(mm.ResourceLabels()), "rule promotes none")
+
+	mm = matcher("example.com/db/queries")
+	u.Is(true, nil == mm.ResourceLabels(), "no rule means all labels")
+}
+
+func TestScaleKey(t *testing.T) {
+	var u = tutl.New(t)
+
+	cfg := Configuration{
+		System:    "gcp",
+		Subsystem: map[string]string{"example.com/svc/": "svc"},
+		Unit:      map[string]string{"ms": "/1000", "By": "*8"},
+	}
+	matcher := func(unit string) *MetricMatcher {
+		return cfg.MatchMetric(&sd.MetricDescriptor{
+			Type: "example.com/svc/latency", MetricKind: "GAUGE",
+			ValueType: "DOUBLE", Unit: unit,
+		})
+	}
+
+	mm := matcher("ms")
+	u.Is("/1000", mm.ScaleKey(), "scaled metric")
+	_, key := mm.Scaler()
+	u.Is(key, mm.ScaleKey(), "ScaleKey matches Scaler")
+
+	mm = matcher("By/s")
+	u.Is("(*8)/()", mm.ScaleKey(), "composite scaled metric")
+	_, key = mm.Scaler()
+	u.Is(key, mm.ScaleKey(), "composite ScaleKey matches Scaler")
+
+	u.Is("", matcher("").ScaleKey(), "unscaled metric")
+	u.Is("", matcher("s").ScaleKey(), "unit not in Unit map")
+	u.Is("", matcher("1/s").ScaleKey(), "composite not in Unit map")
+}
+
+func TestRound(t *testing.T) {
+	var u = tutl.New(t)
+
+	cfg := Configuration{
+		System:    "gcp",
+		Subsystem: map[string]string{"example.com/svc/": "svc"},
+		Unit:      map[string]string{"ns": "/1000/1000/1000"},
+		Round: []RoundConf{
+			{For: Selector{Suffix: []string{"/latency"}}, Places: 3},
+			{For: Selector{Suffix: []string{"/load"}}, Places: 0},
+		},
+	}
+	matcher := func(name, unit string) *MetricMatcher {
+		return cfg.MatchMetric(&sd.MetricDescriptor{
+			Type: "example.com/svc/" + name, MetricKind: "GAUGE",
+			ValueType: "DOUBLE", Unit: unit,
+		})
+	}
+
+	mm := matcher("latency", "ns")
+	scale, _ := mm.Scaler()
+	round := mm.Rounder()
+	u.Is(1.235, round(scale(1234567890)), "ns scaled then rounded to 3 places")
+	u.Is(0.0, round(scale(400000)), "tiny value rounds to zero")
+	u.Is(1.23456789, scale(1234567890), "Scaler() itself does not round")
+
+	mm = matcher("load", "1")
+	scale, _ = mm.Scaler()
+	u.Is(true, nil == scale, "unscaled metric")
+	u.Is(3.0, mm.Rounder()(2.71828), "unscaled value rounded to 0 places")
+
+	u.Is(true, nil == matcher("other", "ns").Rounder(),
+		"no matching rule means no rounding")
+
+	_, err := LoadConfigFrom(strings.NewReader(
+		"system: gcp\nround:\n  - places: -1\n"), "neg-round")
+	u.Like(err, "negative places", "*invalid round", "-1", "neg-round")
+	_, err = LoadConfigFrom(strings.NewReader(
+		"system: gcp\nround:\n  - for: {suffix: [x]}\n    places: 2\n"), "")
+	u.Is(nil, err, "valid round")
+}
+
+func TestCommaSeparatedBraces(t *testing.T) {
+	var u = tutl.New(t)
+
+	u.Is([]string{"s", "ms", "ns"}, commaSeparated(" s, ms ,ns ", false),
+		"plain list")
+	u.Is(true, nil == commaSeparated("ms", true), "single is nil")
+	u.Is([]string{"{requests,errors}", "By"},
+		commaSeparated("{requests,errors}, By", false), "braced comma")
+	u.Is(true, nil == commaSeparated(" {a,b} ", true),
+		"braced comma is single")
+	u.Is([]string{"{a,{b,c}}", "d"}, commaSeparated("{a,{b,c}},d", false),
+		"nested braces")
+	u.Is([]string{"a}", "b"}, commaSeparated("a},b", false),
+		"unmatched close brace")
+	u.Is([]string{"a", "{b,c"}, commaSeparated("a,{b,c", false),
+		"unclosed brace")
+	u.Is([]string{"}{,x"}, commaSeparated("}{,x", false),
+		"reversed braces leave a brace open")
+	u.Is([]string{"1/{a,b}"}, commaSeparated(",1/{a,b},", false),
+		"empty items dropped")
+}
+
+func TestUnitSelector(t *testing.T) {
+	var u = tutl.New(t)
+
+	cfg := Configuration{
+		System:    "gcp",
+		Subsystem: map[string]string{"example.com/svc/": "svc"},
+	}
+	withUnit := func(unit string) *MetricMatcher {
+		return cfg.MatchMetric(&sd.MetricDescriptor{
+			Type: "example.com/svc/thing", MetricKind: "GAUGE",
+			ValueType: "INT64", Unit: unit,
+		})
+	}
+	for _, c := range []struct {
+		sel   string
+		units map[string]bool
+	}{
+		{"By", map[string]bool{"By": true, "By/s": false, "1": false}},
+		{"!1", map[string]bool{"1": false, "By": true, "": true}},
+		{"!1,!-", map[string]bool{"1": false, "": false, "s": true}},
+		{"By*", map[string]bool{
+			"By": true, "By/s": true, "kBy": false, "1": false}},
+		{"By*,!By/s", map[string]bool{
+			"By": true, "By/s": false, "By/min": true, "s": false}},
+		{"!By/s,By*", map[string]bool{"By/s": false, "By": true}},
+		{"s,ms,!s", map[string]bool{"s": false, "ms": true, "us": false}},
+		{"!*", map[string]bool{"1": false, "": false}},
+		{"{}/s,!{}*", map[string]bool{"{Bytes}/s": false, "1/s": false}},
+	} {
+		for unit, want := range c.units {
+			mm := withUnit(unit)
+			u.Is(want, mm.matches(Selector{Unit: c.sel}),
+				u.S("unit ", c.sel, " vs ", mm.Unit))
+		}
+	}
+
+	conf, err := LoadConfigFrom(strings.NewReader(
+		"system: gcp\nhistogram:\n- for:\n    unit: \"!1,By*\"\n",
+	), "")
+	if u.Is(nil, err, "load negated unit") {
+		u.Is("!1,By*", conf.Histogram[0].For.Unit, "quoted negation kept")
+	}
+}
+
+func TestSamplePeriodSelector(t *testing.T) {
+	var u = tutl.New(t)
+
+	cfg := Configuration{
+		System:    "gcp",
+		Subsystem: map[string]string{"example.com/svc/": "svc"},
+	}
+	withPeriod := func(meta *sd.MetricDescriptorMetadata) *MetricMatcher {
+		return cfg.MatchMetric(&sd.MetricDescriptor{
+			Type: "example.com/svc/thing", MetricKind: "GAUGE",
+			ValueType: "INT64", Metadata: meta,
+		})
+	}
+	period := func(p string) *MetricMatcher {
+		return withPeriod(&sd.MetricDescriptorMetadata{SamplePeriod: p})
+	}
+	upTo1m := Selector{MaxSamplePeriod: time.Minute}
+	from10s := Selector{MinSamplePeriod: 10 * time.Second}
+	within := Selector{
+		MinSamplePeriod: 10 * time.Second, MaxSamplePeriod: time.Minute}
+
+	u.Is(true, period("60s").matches(upTo1m), "at max")
+	u.Is(true, period("1s").matches(upTo1m), "below max")
+	u.Is(false, period("300s").matches(upTo1m), "above max")
+	u.Is(true, period("10s").matches(from10s), "at min")
+	u.Is(false, period("0.5s").matches(from10s), "below min")
+	u.Is(true, period("3600s").matches(from10s), "far above min")
+	u.Is(true, period("30s").matches(within), "in range")
+	u.Is(false, period("5s").matches(within), "under range")
+	u.Is(false, period("120s").matches(within), "over range")
+	u.Is(true, period("120s").matches(Selector{}), "no limits")
+
+	unknown := Selector{MaxSamplePeriod: time.Minute, UnknownSamplePeriod: true}
+	for desc, mm := range map[string]*MetricMatcher{
+		"no metadata": withPeriod(nil),
+		"no period":   withPeriod(&sd.MetricDescriptorMetadata{}),
+		"bad period":  period("often"),
+	} {
+		u.Is(false, mm.matches(upTo1m), desc+" excluded by default")
+		u.Is(true, mm.matches(unknown), desc+" included if configured")
+		u.Is(true, mm.matches(Selector{}), desc+" ok without limits")
+	}
+	u.Is(false, period("120s").matches(unknown), "known period still checked")
+
+	conf, err := LoadConfigFrom(strings.NewReader("system: gcp\n"+
+		"drop:\n- minsampleperiod: 2m\n  unknownsampleperiod: true\n",
+	), "")
+	if u.Is(nil, err, "load sample period") {
+		u.Is(2*time.Minute, conf.Drop[0].MinSamplePeriod, "duration parsed")
+		u.Is(true, conf.Drop[0].UnknownSamplePeriod, "unknown parsed")
+	}
+}
+
+func TestBucketLayout(t *testing.T) {
+	var u = tutl.New(t)
+
+	conf, err := LoadConfigFrom(strings.NewReader(`
+system: gcp
+subsystem:
+  example.com/svc/: svc
+bucketlayout:
+  latency: [0.01, 0.1, 1, 10]
+histogram:
+- for:
+    prefix: [example.com/svc/api_latencies, example.com/svc/db_latencies]
+  layout: latency
+- minbuckets: 4
+  minratio: 2
+`), "")
+	if !u.Is(nil, err, "load layouts") {
+		return
+	}
+	hist := func(name string) *MetricMatcher {
+		return conf.MatchMetric(&sd.MetricDescriptor{
+			Type: "example.com/svc/" + name, MetricKind: "CUMULATIVE",
+			ValueType: "DISTRIBUTION", Unit: "s",
+		})
+	}
+	want := []float64{0.01, 0.1, 1, 10}
+	u.Is(want, hist("api_latencies").BucketLayout(), "api uses layout")
+	u.Is(want, hist("db_latencies").BucketLayout(), "db uses same layout")
+	u.Is(0, len(hist("other_latencies").BucketLayout()), "other resampled")
+	minBuckets, _, minRatio, _, _ := hist("other_latencies").HistogramLimits()
+	u.Is(4, minBuckets, "other keeps limits")
+	u.Is(2.0, minRatio, "other keeps ratio")
+
+	for _, c := range []struct{ yaml, err string }{
+		{"histogram:\n- layout: nope\n", `layout "nope" not found`},
+		{"bucketlayout:\n  flat: [1, 2, 2]\n", `"flat" .* not increasing`},
+		{"bucketlayout:\n  down: [3, 1]\n", `"down" .* not increasing`},
+		{"bucketlayout:\n  none: []\n", `"none" .* no boundaries`},
+	} {
+		_, err := LoadConfigFrom(
+			strings.NewReader("system: gcp\n"+c.yaml), "")
+		u.Like(err, u.S("invalid layout ", c.yaml), c.err)
+	}
+}
+
+func TestUnitOverride(t *testing.T) {
+	var u = tutl.New(t)
+
+	conf, err := LoadConfigFrom(strings.NewReader(`
+system: gcp
+subsystem:
+  example.com/svc/: svc
+unit:
+  MiBy: "*1024*1024"
+unitoverride:
+  "{operations}": "{operations}"
+  "{MiBy}": MiBy
+histogram:
+- for:
+    unit: "{operations}"
+  maxbuckets: 10
+`), "")
+	if !u.Is(nil, err, "load overrides") {
+		return
+	}
+	withUnit := func(unit string) *MetricMatcher {
+		return conf.MatchMetric(&sd.MetricDescriptor{
+			Type: "example.com/svc/thing", MetricKind: "GAUGE",
+			ValueType: "DISTRIBUTION", Unit: unit,
+		})
+	}
+
+	u.Is("{}", withUnit("{requests}").Unit, "default annotation")
+	u.Is("-", withUnit("").Unit, "default empty unit")
+	u.Is("{}/s", withUnit("{ops}/s").Unit, "default composite")
+
+	ops := withUnit("{operations}")
+	u.Is("{operations}", ops.Unit, "annotation preserved")
+	_, _, _, _, maxBuckets := ops.HistogramLimits()
+	u.Is(10, maxBuckets, "preserved annotation selected")
+	_, _, _, _, maxBuckets = withUnit("{requests}").HistogramLimits()
+	u.Is(0, maxBuckets, "other annotation not selected")
+
+	mib := withUnit("{MiBy}")
+	u.Is("MiBy", mib.Unit, "annotation mapped to unit")
+	f, key := mib.Scaler()
+	u.Is("*1024*1024", key, "mapped unit scaled")
+	if u.IsNot(nil, f, "mapped unit has scaler") {
+		u.Is(2097152.0, f(2), "mapped unit scaling")
+	}
+	f, _ = withUnit("{By}").Scaler()
+	u.Is(nil, f, "unmapped annotation not scaled")
+
+	for _, c := range []struct{ yaml, err string }{
+		{`"{x}": ""`, `unitoverride for "{x}" [(]""[)]`},
+		{`"{x}": "a,b"`, `unitoverride for "{x}"`},
+		{`"{x}": "By s"`, `unitoverride for "{x}"`},
+		{`"{x}": "!By"`, `unitoverride for "{x}"`},
+		{`"{x}": "By*"`, `unitoverride for "{x}"`},
+		{`" {x}": "By"`, `unitoverride key .* whitespace`},
+	} {
+		_, err := LoadConfigFrom(strings.NewReader(
+			"system: gcp\nunitoverride:\n  "+c.yaml+"\n"), "")
+		u.Like(err, u.S("invalid override ", c.yaml), c.err)
+	}
+}
+
+// Returns a copy of 'md' with only the fields listed in 'mask' (using the
+// partial-response syntax of RequiredDescriptorFields()).
+func maskDescriptor(md *sd.MetricDescriptor, mask []string) *sd.MetricDescriptor {
+	full, _ := json.Marshal(md)
+	var all map[string]interface{}
+	json.Unmarshal(full, &all)
+	kept := make(map[string]interface{})
+	for _, field := range mask {
+		parts := strings.SplitN(field, "/", 2)
+		val, ok := all[parts[0]]
+		if !ok {
+			continue
+		} else if 1 == len(parts) {
+			kept[parts[0]] = val
+			continue
+		}
+		switch v := val.(type) {
+		case []interface{}:
+			prev, _ := kept[parts[0]].([]interface{})
+			for i, item := range v {
+				if len(prev) <= i {
+					prev = append(prev, map[string]interface{}{})
+				}
+				prev[i].(map[string]interface{})[parts[1]] =
+					item.(map[string]interface{})[parts[1]]
+			}
+			kept[parts[0]] = prev
+		case map[string]interface{}:
+			prev, _ := kept[parts[0]].(map[string]interface{})
+			if nil == prev {
+				prev = make(map[string]interface{})
+			}
+			prev[parts[1]] = v[parts[1]]
+			kept[parts[0]] = prev
+		}
+	}
+	masked, _ := json.Marshal(kept)
+	out := new(sd.MetricDescriptor)
+	json.Unmarshal(masked, out)
+	return out
+}
+
+func TestRequiredDescriptorFields(t *testing.T) {
+	var u = tutl.New(t)
+
+	md := &sd.MetricDescriptor{
+		Type:        "example.com/svc/latencies",
+		MetricKind:  "DELTA",
+		ValueType:   "DISTRIBUTION",
+		Unit:        "ms",
+		Description: "How long requests took.",
+		DisplayName: "Latencies",
+		LaunchStage: "GA",
+		Name:        "projects/p/metricDescriptors/example.com/svc/latencies",
+		Labels: []*sd.LabelDescriptor{
+			{Key: "method", ValueType: "STRING", Description: "RPC method"},
+			{Key: "status", ValueType: "INT64", Description: "Result"},
+		},
+		Metadata: &sd.MetricDescriptorMetadata{
+			IngestDelay: "60s", SamplePeriod: "60s", LaunchStage: "GA",
+		},
+	}
+	// Label keys are requested even without label rules since they are
+	// needed to build each Prometheus metric's labels:
+	plain := Configuration{
+		System:    "gcp",
+		Subsystem: map[string]string{"example.com/svc/": "svc"},
+	}
+	want := plain.RequiredDescriptorFields()
+	u.Is(true, 0 < len(want), "mask not empty")
+	for _, cfg := range []Configuration{plain, {
+		System:    "gcp",
+		Subsystem: map[string]string{"example.com/svc/": "svc"},
+		Unit:      map[string]string{"ms": "/1000"},
+	}, {
+		System:    "gcp",
+		Subsystem: map[string]string{"example.com/svc/": "svc"},
+		OmitLabel: []OmitLabelConf{{Labels: []string{"status"}}},
+	}, {
+		System:    "gcp",
+		Subsystem: map[string]string{"example.com/svc/": "svc"},
+		Drop:      []Selector{{MinSamplePeriod: time.Hour}},
+	}} {
+		mask := cfg.RequiredDescriptorFields()
+		u.Is(want, mask, "mask does not depend on config")
+		slim := maskDescriptor(md, mask)
+		u.Is("", slim.LaunchStage, "launch stage not requested")
+		u.Is("", slim.Name, "name not requested")
+		if u.Is(2, len(slim.Labels), "label keys requested") {
+			u.Is("method", slim.Labels[0].Key, "first label key")
+			u.Is("", slim.Labels[0].Description, "label desc not requested")
+		}
+		if u.IsNot(nil, slim.Metadata, "metadata requested") {
+			u.Is("60s", slim.Metadata.SamplePeriod, "sample period")
+			u.Is("60s", slim.Metadata.IngestDelay, "ingest delay")
+		}
+
+		full, part := cfg.MatchMetric(md), cfg.MatchMetric(slim)
+		if u.IsNot(nil, part, "masked descriptor still matches") {
+			u.Is(full.PromName(), part.PromName(), "same name")
+			u.Is(full.Unit, part.Unit, "same unit")
+			u.Is(full.Kind, part.Kind, "same kind")
+			u.Is(full.Type, part.Type, "same type")
+			u.Is(full.OmitLabels(), part.OmitLabels(), "same omitted labels")
+			u.Is(md.Description, slim.Description, "same help text")
+		}
+	}
+}
+
+func TestDefaultPrefix(t *testing.T) {
+	var u = tutl.New(t)
+
+	cfg := Configuration{
+		System: "gcp",
+		Subsystem: map[string]string{
+			"pubsub.googleapis.com/subscription/": "pubsub_sub",
+			"example.com/":                        "example",
+		},
+		DefaultPrefix: []string{
+			"pubsub.googleapis.com/", "example.com/api/",
+		},
+	}
+	name := func(typ string) string {
+		mm := cfg.MatchMetric(&sd.MetricDescriptor{
+			Type: typ, MetricKind: "GAUGE", ValueType: "INT64", Unit: "1",
+		})
+		if nil == mm {
+			return ""
+		}
+		return mm.PromName()
+	}
+
+	u.Is("gcp_pubsub_sub_num_undelivered_messages",
+		name("pubsub.googleapis.com/subscription/num_undelivered_messages"),
+		"explicit longer prefix wins")
+	u.Is("gcp_topic_byte_cost", name("pubsub.googleapis.com/topic/byte_cost"),
+		"default derives subsystem")
+	u.Is("gcp_snapshot_backlog_bytes",
+		name("pubsub.googleapis.com/snapshot/backlog/bytes"),
+		"default keeps deeper path in name")
+	u.Is("", name("pubsub.googleapis.com/loose_metric"),
+		"default needs a segment after prefix")
+	u.Is("gcp_v2_requests", name("example.com/api/v2/requests"),
+		"default longer than explicit prefix wins")
+	u.Is("gcp_example_other_requests", name("example.com/other/requests"),
+		"explicit used outside of default")
+	u.Is("", name("other.googleapis.com/x/y"), "still unmatched")
+
+	u.Is([]string{"example.com/", "pubsub.googleapis.com/"},
+		sortedStrings(cfg.GcpPrefixes()), "default prefixes are fetched")
+	u.Is([]PrefixCount{{"other.googleapis.com/x/", 1}},
+		cfg.UnmatchedPrefixes([]*sd.MetricDescriptor{
+			{Type: "pubsub.googleapis.com/topic/byte_cost"},
+			{Type: "other.googleapis.com/x/y"},
+		}), "default prefix counts as matched")
+
+	conf, err := LoadConfigFrom(strings.NewReader(
+		"system: gcp\ndefaultprefix: [\"pubsub.googleapis.com/\"]\n"), "")
+	if u.Is(nil, err, "load defaultprefix") {
+		u.Is([]string{"pubsub.googleapis.com/"}, conf.DefaultPrefix,
+			"defaultprefix loaded")
+	}
+	u.Is(nil, cfg.Validate(), "valid defaultprefix")
+	_, err = LoadConfigFrom(strings.NewReader(
+		"system: gcp\ndefaultprefix: [\"pubsub.googleapis.com\"]\n"), "slash")
+	u.Like(err, "defaultprefix without slash",
+		"*invalid config in slash", `"pubsub.googleapis.com"`, "end in '/'")
+	cfg.DefaultPrefix = []string{"example.com/api"}
+	u.Like(cfg.Validate(), "built defaultprefix without slash",
+		"*invalid defaultprefix", `"example.com/api"`)
+}
+
+func sortedStrings(list []string) []string {
+	sort.Strings(list)
+	return list
+}
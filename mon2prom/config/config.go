@@ -2,13 +2,17 @@ package config
 
 import (
 	"fmt"
+	"io"
+	"math"
 	"os"
 	"regexp"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/Unity-Technologies/go-lager-internal"
 	"github.com/Unity-Technologies/tools-gcp-internal/mon"
+	"github.com/prometheus/client_golang/prometheus"
 	sd "google.golang.org/api/monitoring/v3"
 	"gopkg.in/yaml.v2"
 )
@@ -29,7 +33,21 @@ import (
 // Histogram, Float, Int, Bool, and String.
 //
 // For Unit, '' becomes '-' and values (or parts of values) like '{Bytes}'
-// become '{}'.
+// become '{}'.  A unit ending in '*' matches any unit starting with what
+// comes before the '*' (so "By*" matches "By" and "By/s").  A unit starting
+// with '!' excludes matching units (so "!1" matches any unit except "1").
+// Exclusions take precedence: a metric whose unit matches any '!' item never
+// matches.  Otherwise, if there are any items without '!', the unit must
+// match one of them.  So "By*,!By/s" matches byte units other than "By/s"
+// and "!1,!-" matches any unit that is not dimensionless.  Note that YAML
+// requires quoting a value that starts with '!', as in `unit: "!1"`.
+//
+// MinSamplePeriod and MaxSamplePeriod restrict to metrics whose
+// Metadata.SamplePeriod (how often GCP samples the metric) is within that
+// (inclusive) range, such as `maxsampleperiod: 60s` to skip metrics that are
+// sampled less often than they are scraped.  A zero value means no limit.
+// A metric whose descriptor has no (or an unparsable) sample period only
+// matches such a Selector if UnknownSamplePeriod is true.
 //
 type Selector struct {
 	Prefix []string // Prefix(es) to match against full GCP metric paths.
@@ -37,6 +55,10 @@ type Selector struct {
 	Only   string   // Required attributes (letters from "CDGHFIBS").
 	Not    string   // Disallowed attributes (letters from "CDGHFIBS").
 	Unit   string   // Required unit designation(s) (comma-separated).
+
+	MinSamplePeriod     time.Duration // Shortest sample period to match.
+	MaxSamplePeriod     time.Duration // Longest sample period to match.
+	UnknownSamplePeriod bool          // Match if sample period is unknown.
 }
 
 // MetricMatcher contains the information about one type of GCP metric.
@@ -58,7 +80,7 @@ type MetricMatcher struct {
 	// histogram (distribution), or bool.
 	Type mon.ValueType
 	// MD.Unit but '' becomes '-' and values (or parts of values) like
-	// '{Bytes}' are replaced by just '{}'.
+	// '{Bytes}' are replaced by just '{}' (unless UnitOverride says otherwise).
 	Unit string
 }
 
@@ -121,6 +143,24 @@ type HistogramConf struct {
 	// ignored and will not be exported to Prometheus.
 	//
 	MaxBuckets int
+
+	// Layout names an entry in the BucketLayout config whose bucket
+	// boundaries are exported instead of the (resampled) GCP boundaries,
+	// so MinBuckets, MinBound, MinRatio, and MaxBound are ignored.  Each
+	// GCP bucket's count is added to the first layout bucket whose
+	// boundary is not below the GCP bucket's (scaled) upper boundary, or
+	// to the +Inf bucket if there is no such layout bucket.
+	//
+	Layout string
+}
+
+// RoundConf is a rule for rounding metric values (after any scaling from
+// the Unit config is applied) to reduce excess precision, such as from
+// converting nanoseconds to seconds.
+//
+type RoundConf struct {
+	For    Selector // Selects which metrics to round.
+	Places int      // Number of decimal places to keep (0 or more).
 }
 
 // OmitLabelConf specifies a rule for identifying labels to be omitted
@@ -132,6 +172,15 @@ type OmitLabelConf struct {
 	Labels []string // The list of metric labels to ignore.
 }
 
+// ResourceLabelConf specifies a rule for choosing which labels of the
+// monitored resource (such as "zone" or "instance_id") are included as
+// labels on the metrics exported to Prometheus.
+//
+type ResourceLabelConf struct {
+	For            Selector // Selects which metrics to check.
+	ResourceLabels []string // The resource labels to include.
+}
+
 // SuffixConf is a rule for adjusting the last part of Prometheus metric
 // names by replacing a suffix.  The For element determines which metrics
 // this rule applies to.
@@ -148,9 +197,14 @@ type OmitLabelConf struct {
 // before comparing it to each Replace key so you can use a key like
 // "/port_usage" to match (and replace) the whole name, not just a suffix.
 //
+// If Stop is true and this rule actually replaced a suffix, then no further
+// Suffix rules are applied to that metric.  A rule that matches but finds
+// no key to replace does not stop subsequent rules from being applied.
+//
 type SuffixConf struct {
 	For     Selector
 	Replace map[string]string
+	Stop    bool
 	keys    []string // Keys from Replace, longest to shortest.
 }
 
@@ -181,6 +235,19 @@ type Configuration struct {
 	//
 	Subsystem map[string]string
 
+	// DefaultPrefix lists GCP metric path prefixes (each ending in '/') under
+	// which every metric gets exported without listing each in Subsystem.
+	// The path segment after the prefix becomes the metric's subsystem and
+	// the rest becomes the last part of its name.  For example, with
+	// "pubsub.googleapis.com/", "pubsub.googleapis.com/topic/byte_cost"
+	// gets the subsystem "topic".  Metrics with no further '/' after the
+	// prefix are not matched this way.
+	//
+	// A matching Subsystem prefix that is at least as long as the matching
+	// DefaultPrefix takes precedence.
+	//
+	DefaultPrefix []string
+
 	// Unit maps a unit name to the name of a predefined scaling factor to
 	// convert to base units that are preferred in Prometheus.  The names
 	// of the conversion functions look like multiplication or division
@@ -192,8 +259,28 @@ type Configuration struct {
 	// If you use the same unit type in multiple entries, then which of those
 	// entries that will be applied to a metric will be "random".
 	//
+	// If a metric's whole unit (like "By/s") is not listed but contains a
+	// '/', then the parts before and after the first '/' are each looked
+	// up and scaled independently.  For example, with `"By": "*8"`, values
+	// in "By/s" are converted to bits per second and, with `"ms": "/1000"`,
+	// values in "1/ms" are converted to "per second".
+	//
 	Unit map[string]string
 
+	// UnitOverride maps a raw GCP unit (exactly as found in a metric
+	// descriptor) to the normalized unit to use instead of the default
+	// normalization (where '' becomes '-' and annotations like '{Bytes}'
+	// become '{}').  The normalized unit is what Selector Unit items and
+	// the Unit scaling rules are compared to.  For example,
+	// `"{operations}": "{operations}"` preserves that annotation and
+	// `"{MiBy}": "MiBy"` lets a "MiBy" Unit rule scale that metric.
+	//
+	// Normalized units must not be empty and must not contain commas or
+	// whitespace nor start with '!' nor end with '*' (as those have
+	// special meanings in a Selector's Unit).
+	//
+	UnitOverride map[string]string
+
 	// Histogram is a list of rules for resampling histogram metrics to reduce
 	// the number of buckets or to simply ignore histogram metrics with too
 	// many buckets.
@@ -203,6 +290,22 @@ type Configuration struct {
 	//
 	Histogram []HistogramConf
 
+	// BucketLayout maps a name to a list of Prometheus histogram bucket
+	// boundaries, which must be strictly increasing.  A Histogram rule can
+	// select a layout by name (via its Layout item) so that many metrics
+	// get exported with the same buckets, regardless of their GCP buckets.
+	// Boundaries are compared to GCP boundaries after any Unit scaling.
+	//
+	BucketLayout map[string][]float64
+
+	// Round is a list of rules for rounding metric values after they are
+	// scaled.  Only the first matching rule (for each metric) is applied.
+	// Metrics that match no rule are not rounded.  Only the exported value
+	// is rounded, so DELTA metrics and histogram sums accumulate unrounded
+	// values.  Histogram bucket boundaries are never rounded.
+	//
+	Round []RoundConf
+
 	// OmitLabel specifies rules for identifying labels to be omitted from
 	// the metrics exported to Prometheus.  This is usually used to remove
 	// labels that would cause high-cardinality metrics.
@@ -212,12 +315,44 @@ type Configuration struct {
 	//
 	OmitLabel []OmitLabelConf
 
+	// ResourceLabel specifies rules for choosing which monitored-resource
+	// labels are included on the metrics exported to Prometheus.  If no
+	// rule matches a metric, then all of its resource labels are included.
+	// If any rules match, then only the resource labels listed in any of
+	// the matching rules are included (so a matching rule that lists no
+	// labels means no resource labels are included).  OmitLabel rules
+	// still apply to the included resource labels.
+	//
+	ResourceLabel []ResourceLabelConf
+
 	// Suffix is a list of rules for adjusting the last part of Prometheus
 	// metric names by replacing a suffix.  Rules are applied in the order
 	// listed and each rule that applies will change the Prometheus metric
-	// name that will be used for matching subsequent rules.
+	// name that will be used for matching subsequent rules (unless the rule
+	// has Stop set and it replaced a suffix).
 	//
 	Suffix []*SuffixConf
+
+	// Drop is a list of Selectors for metrics that should not be exported
+	// even though their prefix is listed in Subsystem.  Drop Selectors are
+	// evaluated after all Suffix rules have been applied, so any Suffix in
+	// a Drop Selector is compared to the final Prometheus metric name.  A
+	// dropped metric is not exported at all, so Drop takes precedence over
+	// any other rules (such as OmitLabel) that also match the metric.
+	//
+	Drop []Selector
+
+	// NameStyle controls how the subsystem and final part of each
+	// Prometheus metric name are cleaned up.  One of:
+	//
+	//      raw (or empty)        Replace each run of characters not
+	//                            allowed in metric names with one '_'.
+	//      collapse_underscores  Like raw but then also collapse runs of
+	//                            '_' and trim leading and trailing '_'.
+	//      lowercase             Like collapse_underscores but also
+	//                            converts letters to lower case.
+	//
+	NameStyle string
 }
 
 type ScalingFunc func(float64) float64
@@ -229,10 +364,21 @@ var ConfigFile = "gcp2prom.yaml"
 // Map from config file path to loaded Configuration
 var configs = make(map[string]*Configuration)
 
+var configLoadTime = mon.NewGaugeVec(
+	"gcp2prom", "config", "last_load_timestamp_seconds",
+	"Unix time when the config at each path was last successfully loaded.",
+	"path",
+)
+
+func init() {
+	prometheus.MustRegister(configLoadTime)
+}
+
 var Scale = map[string]ScalingFunc{
 	"*1024*1024*1024": multiply(1024.0 * 1024.0 * 1024.0),
 	"*1024*1024":      multiply(1024.0 * 1024.0),
 	"*60*60*24":       multiply(60.0 * 60.0 * 24.0),
+	"*8":              multiply(8.0),
 	"/100":            divide(100.0),
 	"/1000":           divide(1000.0),
 	"/1000/1000":      divide(1000.0 * 1000.0),
@@ -249,6 +395,12 @@ func divide(d float64) ScalingFunc {
 	return func(f float64) float64 { return f / d }
 }
 
+// Returns a ScalingFunc that rounds values to 'places' decimal places.
+func rounder(places int) ScalingFunc {
+	p := math.Pow(10, float64(places))
+	return func(f float64) float64 { return math.Round(f*p) / p }
+}
+
 type LongestFirst []string
 
 func (p LongestFirst) Len() int           { return len(p) }
@@ -270,18 +422,62 @@ func longestKeysFirst(m map[string]string) []string {
 	return strs
 }
 
-func commaSeparated(list string, nilForSingle bool) []string {
-	if !strings.Contains(list, ",") {
-		if nilForSingle {
-			return nil
-		} else if list = strings.TrimSpace(list); "" == list {
-			return []string{}
+// Returns whether 'unit' is selected by the Selector.Unit items in 'list',
+// which can use a leading '!' (exclude) and a trailing '*' (prefix match).
+//
+func unitMatches(list []string, unit string) bool {
+	wanted, match := false, false
+	for _, item := range list {
+		negate := strings.HasPrefix(item, "!")
+		if negate {
+			item = item[1:]
 		} else {
-			return []string{list}
+			wanted = true
+		}
+		hit := item == unit
+		if pre := strings.TrimSuffix(item, "*"); pre != item {
+			hit = strings.HasPrefix(unit, pre)
+		}
+		if hit && negate {
+			return false
+		} else if hit {
+			match = true
 		}
 	}
+	return match || !wanted
+}
+
+// Splits 'list' on commas, trimming whitespace from each item and dropping
+// empty items.  Commas inside of '{...}' (such as in the unit
+// "{requests,errors}") do not separate items.  An unmatched '}' is kept as
+// part of the item and an unmatched '{' means no later commas separate
+// items.  If 'nilForSingle', then returns `nil` if 'list' has no
+// separating commas.
+//
+func commaSeparated(list string, nilForSingle bool) []string {
+	items := make([]string, 0, 1+strings.Count(list, ","))
+	depth := 0
+	beg := 0
+	for i, c := range list {
+		switch c {
+		case '{':
+			depth++
+		case '}':
+			if 0 < depth {
+				depth--
+			}
+		case ',':
+			if 0 == depth {
+				items = append(items, list[beg:i])
+				beg = i + 1
+			}
+		}
+	}
+	if nilForSingle && 0 == len(items) {
+		return nil
+	}
+	items = append(items, list[beg:])
 
-	items := strings.Split(list, ",")
 	o := 0
 	for _, v := range items {
 		v = strings.TrimSpace(v)
@@ -293,26 +489,55 @@ func commaSeparated(list string, nilForSingle bool) []string {
 	return items[:o]
 }
 
+// LoadConfig() reads the YAML configuration file at 'path' (or at
+// ConfigFile if 'path' is "").  Each path is only loaded once; later calls
+// return the cached Configuration.
+//
 func LoadConfig(path string) (Configuration, error) {
 	if "" == path {
 		path = ConfigFile
 	}
-
-	conf := configs[path]
-	if nil != conf {
-		return *conf, nil
+	if conf, ok := cachedConfig(path); ok {
+		return conf, nil
 	}
-	conf = new(Configuration)
 
 	r, err := os.Open(path)
 	if nil != err {
-		return *conf, err
+		return Configuration{}, err
+	}
+	defer r.Close()
+	return LoadConfigFrom(r, path)
+}
+
+// LoadConfigFrom() reads YAML configuration from 'r', such as from a file
+// embedded via '//go:embed' or fetched from a config service.  'name' is
+// used in error messages and as the cache key; if a Configuration was
+// already loaded under 'name', then it is returned and 'r' is not read.
+// Pass "" for 'name' to neither check nor update the cache (error messages
+// then refer to "<reader>").
+//
+// Each successful (uncached) load under a non-empty 'name' sets the
+// gcp2prom_config_last_load_timestamp_seconds gauge for that 'name' (as
+// the "path" label) to the current time.
+//
+func LoadConfigFrom(r io.Reader, name string) (Configuration, error) {
+	if c, ok := cachedConfig(name); ok {
+		return c, nil
+	}
+	cacheKey := name
+	if "" == name {
+		name = "<reader>"
 	}
+	conf := new(Configuration)
+
 	y := yaml.NewDecoder(r)
 	y.SetStrict(true)
-	err = y.Decode(conf)
+	err := y.Decode(conf)
 	if nil != err {
-		return *conf, fmt.Errorf("Invalid yaml in %s: %v", path, err)
+		return *conf, fmt.Errorf("Invalid yaml in %s: %v", name, err)
+	}
+	if err := conf.Validate(); nil != err {
+		return *conf, fmt.Errorf("Invalid config in %s: %v", name, err)
 	}
 	lager.Debug().Map("Loaded config", conf)
 
@@ -336,10 +561,77 @@ func LoadConfig(path string) (Configuration, error) {
 	}
 	lager.Debug().Map("Expanded units scaling", conf.Unit)
 
-	configs[path] = conf
+	if "" != cacheKey {
+		configs[cacheKey] = conf
+		configLoadTime.WithLabelValues(cacheKey).SetToCurrentTime()
+	}
 	return *conf, nil
 }
 
+// Validate() reports the first problem found with settings that cannot be
+// checked by YAML decoding alone: negative Round places, malformed
+// UnitOverride entries, empty or non-increasing BucketLayout boundaries,
+// Histogram layouts not found in BucketLayout, unknown NameStyle values,
+// and DefaultPrefix entries not ending in '/'.  LoadConfigFrom() calls it
+// for you; call it yourself on a Configuration built in code.
+//
+func (c Configuration) Validate() error {
+	for _, r := range c.Round {
+		if r.Places < 0 {
+			return fmt.Errorf(
+				"Invalid round places (%d); must not be negative", r.Places)
+		}
+	}
+	for raw, unit := range c.UnitOverride {
+		if "" == unit || strings.ContainsAny(unit, ", \t\n") ||
+			strings.HasPrefix(unit, "!") || strings.HasSuffix(unit, "*") {
+			return fmt.Errorf("Invalid unitoverride for %q (%q)", raw, unit)
+		} else if raw != strings.TrimSpace(raw) {
+			return fmt.Errorf(
+				"Invalid unitoverride key (%q); has extra whitespace", raw)
+		}
+	}
+	for layout, bounds := range c.BucketLayout {
+		if 0 == len(bounds) {
+			return fmt.Errorf("Bucket layout %q has no boundaries", layout)
+		}
+		for i := 1; i < len(bounds); i++ {
+			if !(bounds[i-1] < bounds[i]) {
+				return fmt.Errorf(
+					"Bucket layout %q is not increasing (%v then %v)",
+					layout, bounds[i-1], bounds[i])
+			}
+		}
+	}
+	for _, h := range c.Histogram {
+		if _, ok := c.BucketLayout[h.Layout]; "" != h.Layout && !ok {
+			return fmt.Errorf(
+				"Histogram layout %q not found in bucketlayout", h.Layout)
+		}
+	}
+	if !nameStyles[c.NameStyle] {
+		return fmt.Errorf("Invalid namestyle (%q); must be raw,"+
+			" collapse_underscores, or lowercase", c.NameStyle)
+	}
+	for _, pref := range c.DefaultPrefix {
+		if !strings.HasSuffix(pref, "/") {
+			return fmt.Errorf(
+				"Invalid defaultprefix (%q); must end in '/'", pref)
+		}
+	}
+	return nil
+}
+
+// cachedConfig() returns the Configuration already loaded under 'name', if
+// any.  Nothing is ever cached under "".
+//
+func cachedConfig(name string) (Configuration, bool) {
+	if conf := configs[name]; "" != name && nil != conf {
+		return *conf, true
+	}
+	return Configuration{}, false
+}
+
 func MustLoadConfig(path string) Configuration {
 	conf, err := LoadConfig(path)
 	if nil != err {
@@ -350,7 +642,17 @@ func MustLoadConfig(path string) Configuration {
 
 // Returns the list of prefixes to GCP metrics that could be handled.
 func (c Configuration) GcpPrefixes() []string {
-	return uniqueKeyPrefixes(c.Subsystem)
+	if 0 == len(c.DefaultPrefix) {
+		return uniqueKeyPrefixes(c.Subsystem)
+	}
+	all := make(map[string]string, len(c.Subsystem)+len(c.DefaultPrefix))
+	for pref, subsys := range c.Subsystem {
+		all[pref] = subsys
+	}
+	for _, pref := range c.DefaultPrefix {
+		all[pref] = ""
+	}
+	return uniqueKeyPrefixes(all)
 }
 
 // Returns the keys that don't have a shorter prefix as another key.  All
@@ -385,21 +687,120 @@ func uniqueKeyPrefixes(m map[string]string) []string {
 //
 // Returns `nil` if the metric is not one that can be exported to Prometheus
 // based on the configuration chosen (because no Subsystem has been configured
-// for it).
+// for it or because it matches a Drop Selector).
 //
 func (c Configuration) MatchMetric(md *sd.MetricDescriptor) *MetricMatcher {
 	mm := new(MetricMatcher)
 	mm.conf = c
 	mm.MD = md
 	mm.Kind, mm.Type, mm.Unit = mon.MetricAbbrs(md)
-	mm.SubSys, mm.Name = subSystem(md.Type, mm.conf.Subsystem)
+	if unit, ok := c.UnitOverride[md.Unit]; ok {
+		mm.Unit = unit
+	}
+	mm.SubSys, mm.Name = c.subSystem(md.Type)
 	if "" == mm.SubSys {
 		return nil
 	}
 	mm.computeName()
+	for _, sel := range c.Drop {
+		if mm.matches(sel) {
+			lager.Debug().Map("Dropping metric", md.Type, "Name", mm.PromName())
+			return nil
+		}
+	}
 	return mm
 }
 
+// ExportedNames() returns the sorted, deduplicated list of Prometheus
+// metric names that would be exported for the given GCP MetricDescriptors.
+// Each descriptor is run through MatchMetric() so descriptors that have no
+// configured Subsystem or that match a Drop Selector are skipped.
+//
+func (c Configuration) ExportedNames(mds []*sd.MetricDescriptor) []string {
+	seen := make(map[string]bool)
+	names := make([]string, 0, len(mds))
+	for _, md := range mds {
+		mm := c.MatchMetric(md)
+		if nil == mm {
+			continue
+		}
+		name := mm.PromName()
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// RequiredDescriptorFields() returns the MetricDescriptor fields that the
+// exporter uses, in the partial-response syntax accepted by the GCP
+// Monitoring API's 'fields' parameter.  Pass them to
+// mon.Client.StreamMetricDescs() to list descriptors with only these fields.
+//
+// The mask is currently the same for every Configuration because each field
+// is needed for every exported metric, whichever config features are in
+// use.  The label keys are needed even when no OmitLabel rules are
+// configured, since they determine which Prometheus labels get exported.
+// Both 'metadata' durations are used to schedule fetching every metric (and
+// a metric without a sample period is not exported), not just by sample
+// period Selectors.  The 'description' is always exported as the help text
+// and the 'unit' is always reported, even when no Unit rule scales it.  The
+// 'launchStage' field (and the labels' value types and descriptions) are
+// not used by any config feature so are never included.
+//
+func (c Configuration) RequiredDescriptorFields() []string {
+	return []string{
+		"type",
+		"metricKind",
+		"valueType",
+		"unit",
+		"description",
+		"labels/key",
+		"metadata/ingestDelay",
+		"metadata/samplePeriod",
+	}
+}
+
+// PrefixCount holds a GCP metric path prefix and how many metrics have it.
+type PrefixCount struct {
+	Prefix string
+	Count  int
+}
+
+// UnmatchedPrefixes() reports which of the given GCP MetricDescriptors would
+// be silently ignored because no Subsystem entry matches them.  Each such
+// metric type is reduced to its prefix (everything up to and including the
+// last '/', the form a Subsystem key would take) and the returned list has
+// one entry per prefix, sorted by prefix, with the count of metrics having
+// it.  Metrics that match a Subsystem but also a Drop Selector are not
+// included.  This does not change what gets exported.
+//
+func (c Configuration) UnmatchedPrefixes(
+	mds []*sd.MetricDescriptor,
+) []PrefixCount {
+	counts := make(map[string]int)
+	for _, md := range mds {
+		if subsys, _ := c.subSystem(md.Type); "" != subsys {
+			continue
+		}
+		prefix := md.Type
+		if i := strings.LastIndex(prefix, "/"); 0 <= i {
+			prefix = prefix[:i+1]
+		}
+		counts[prefix]++
+	}
+	unmatched := make([]PrefixCount, 0, len(counts))
+	for prefix, count := range counts {
+		unmatched = append(unmatched, PrefixCount{prefix, count})
+	}
+	sort.Slice(unmatched, func(i, j int) bool {
+		return unmatched[i].Prefix < unmatched[j].Prefix
+	})
+	return unmatched
+}
+
 // Returns the subsystem name and remaining suffix based on a map of
 // prefixes to subsystem names.  Ensures that the returned suffix begins
 // with a '/' character.  Returns ("","") if there is no matching prefix.
@@ -421,7 +822,61 @@ func subSystem(path string, subs map[string]string) (subsys, suff string) {
 	return "", ""
 }
 
+// Returns the subsystem name and remaining suffix for a GCP metric path
+// based on the configured Subsystem and DefaultPrefix.  The longest matching
+// prefix is used, preferring a Subsystem prefix when lengths are equal.
+// Returns ("","") if nothing matches.
+//
+func (c Configuration) subSystem(path string) (subsys, suff string) {
+	subsys, suff = subSystem(path, c.Subsystem)
+	if 0 == len(c.DefaultPrefix) {
+		return subsys, suff
+	}
+	best := -1 // Length of the longest matching prefix so far
+	for pref, name := range c.Subsystem {
+		if "" != name && best < len(pref) &&
+			strings.HasSuffix(pref, "/") && strings.HasPrefix(path, pref) {
+			best = len(pref)
+		}
+	}
+	for _, pref := range c.DefaultPrefix {
+		if len(pref) <= best || !strings.HasPrefix(path, pref) {
+			continue
+		}
+		rest := path[len(pref):]
+		if i := strings.IndexByte(rest, '/'); 0 < i && i+1 < len(rest) {
+			subsys, suff = rest[:i], rest[i:]
+			best = len(pref)
+		}
+	}
+	return subsys, suff
+}
+
 var notAllowed = regexp.MustCompile("[^a-zA-Z0-9_]+")
+var underscores = regexp.MustCompile("__+")
+
+// The allowed values for Configuration.NameStyle.
+var nameStyles = map[string]bool{
+	"": true, "raw": true, "collapse_underscores": true, "lowercase": true,
+}
+
+// Returns 'name' cleaned up according to the configured NameStyle.
+//
+func (c Configuration) sanitize(name string) string {
+	name = notAllowed.ReplaceAllString(name, "_")
+	if "" == c.NameStyle || "raw" == c.NameStyle {
+		return name
+	}
+	if trimmed := strings.Trim(
+		underscores.ReplaceAllString(name, "_"), "_",
+	); "" != trimmed {
+		name = trimmed
+	}
+	if "lowercase" == c.NameStyle {
+		name = strings.ToLower(name)
+	}
+	return name
+}
 
 // Iterates over Configuration.Suffix rules to successively replace suffixes
 // of the metric name to get the final Prometheus metric name.
@@ -431,19 +886,24 @@ func (mm *MetricMatcher) computeName() {
 		if !mm.matches(s.For) {
 			continue
 		}
+		replaced := false
 		for _, k := range s.keys {
 			if strings.HasSuffix(mm.Name, k) {
 				mm.Name = mm.Name[0:len(mm.Name)-len(k)] + s.Replace[k]
 				if '/' != mm.Name[0] {
 					mm.Name = "/" + mm.Name
 				}
+				replaced = true
 				break
 			}
 		}
+		if replaced && s.Stop {
+			break
+		}
 	}
 
-	mm.Name = "/" + notAllowed.ReplaceAllString(mm.Name[1:], "_")
-	mm.SubSys = notAllowed.ReplaceAllString(mm.SubSys, "_")
+	mm.Name = "/" + mm.conf.sanitize(mm.Name[1:])
+	mm.SubSys = mm.conf.sanitize(mm.SubSys)
 }
 
 // Returns the full metric name to use in Prometheus.
@@ -454,18 +914,77 @@ func (mm *MetricMatcher) PromName() string {
 }
 
 // Returns `nil` or a function that scales float64 values from the units
-// used in GCP to the base units that are preferred in Prometheus.
+// used in GCP to the base units that are preferred in Prometheus.  Also
+// returns the name of the scaling used.  For a composite unit like "By/s"
+// where each part is scaled separately, the name looks like "(*8)/()".
 //
 func (mm *MetricMatcher) Scaler() (ScalingFunc, string) {
-	key := mm.conf.Unit[mm.Unit]
+	key, numKey, denKey := mm.scaleKeys()
 	if "" == key {
 		return nil, ""
+	} else if "" == numKey && "" == denKey {
+		return mm.scaling(key), key
+	}
+	num, den := mm.scaling(numKey), mm.scaling(denKey)
+	if nil == den {
+		return num, key
+	}
+	// Dividing by the size of one denominator unit in base units:
+	per := den(1.0)
+	if nil == num {
+		return divide(per), key
+	}
+	return func(f float64) float64 { return num(f) / per }, key
+}
+
+// Returns the name of the scaling that Scaler() would use for this metric
+// (or "" if values will not be scaled), without building the ScalingFunc.
+// Useful for logging which metrics will be rescaled.
+//
+func (mm *MetricMatcher) ScaleKey() string {
+	key, _, _ := mm.scaleKeys()
+	return key
+}
+
+// Returns the name of the scaling configured for this metric's unit (or ""
+// if none).  If the exact unit has no scaling but the unit is composite
+// (like "By/s") and either part does, then also returns the names of the
+// scalings for the numerator and denominator (either of which may be "").
+//
+func (mm *MetricMatcher) scaleKeys() (key, numKey, denKey string) {
+	if key = mm.conf.Unit[mm.Unit]; "" != key {
+		return key, "", ""
+	}
+	slash := strings.Index(mm.Unit, "/")
+	if slash < 0 {
+		return "", "", ""
+	}
+	numKey = mm.conf.Unit[mm.Unit[:slash]]
+	denKey = mm.conf.Unit[mm.Unit[slash+1:]]
+	if "" == numKey && "" == denKey {
+		return "", "", ""
+	}
+	return compositeKey(numKey, denKey), numKey, denKey
+}
+
+// Returns the name for scaling the numerator and denominator of a
+// composite unit by the named scalings.
+//
+func compositeKey(numKey, denKey string) string {
+	return "(" + numKey + ")/(" + denKey + ")"
+}
+
+// Returns `nil` (if 'key' is "") or the ScalingFunc named 'key'.
+//
+func (mm *MetricMatcher) scaling(key string) ScalingFunc {
+	if "" == key {
+		return nil
 	}
 	f, ok := Scale[key]
 	if !ok {
 		lager.Exit().Map("Unrecognized scale key", key, "For unit", mm.Unit)
 	}
-	return f, key
+	return f
 }
 
 // Returns minBuckets, minBound, minRatio, maxBound, and maxBuckets to use for
@@ -483,6 +1002,31 @@ func (mm *MetricMatcher) HistogramLimits() (
 	return
 }
 
+// Returns the bucket boundaries from the BucketLayout named by the first
+// matching Histogram rule or `nil` if that rule names no Layout (or if no
+// rule matches).
+//
+func (mm *MetricMatcher) BucketLayout() []float64 {
+	for _, s := range mm.conf.Histogram {
+		if mm.matches(s.For) {
+			return mm.conf.BucketLayout[s.Layout]
+		}
+	}
+	return nil
+}
+
+// Returns `nil` or a function that rounds (already scaled) values for this
+// metric based on the first matching Round rule.
+//
+func (mm *MetricMatcher) Rounder() ScalingFunc {
+	for _, r := range mm.conf.Round {
+		if mm.matches(r.For) {
+			return rounder(r.Places)
+		}
+	}
+	return nil
+}
+
 // Returns 'true' if this metric matches the passed-in "For" 'Selector'.
 //
 func (mm *MetricMatcher) matches(s Selector) bool {
@@ -520,15 +1064,18 @@ func (mm *MetricMatcher) matches(s Selector) bool {
 		return false
 	}
 
-	if list := commaSeparated(s.Unit, false); 0 < len(list) {
-		match := false
-		for _, u := range list {
-			if u == mm.Unit {
-				match = true
-				break
-			}
-		}
-		if !match {
+	if list := commaSeparated(s.Unit, false); 0 < len(list) &&
+		!unitMatches(list, mm.Unit) {
+		return false
+	}
+
+	if 0 != s.MinSamplePeriod || 0 != s.MaxSamplePeriod {
+		period, ok := mm.samplePeriod()
+		if !ok {
+			return s.UnknownSamplePeriod
+		} else if 0 != s.MinSamplePeriod && period < s.MinSamplePeriod {
+			return false
+		} else if 0 != s.MaxSamplePeriod && s.MaxSamplePeriod < period {
 			return false
 		}
 	}
@@ -536,6 +1083,40 @@ func (mm *MetricMatcher) matches(s Selector) bool {
 	return true
 }
 
+// Returns the metric's sample period from its descriptor's metadata (such
+// as "60s") and whether it was present and valid.  The value is checked
+// before calling mon.SamplePeriod() since that exits on an invalid duration
+// and a bad descriptor should only fail to match a Selector.
+//
+func (mm *MetricMatcher) samplePeriod() (time.Duration, bool) {
+	if nil != mm.MD.Metadata {
+		_, err := time.ParseDuration(mm.MD.Metadata.SamplePeriod)
+		if nil != err {
+			return 0, false
+		}
+	}
+	period := mon.SamplePeriod(mm.MD)
+	return period, 0 < period
+}
+
+// Returns the names of the monitored-resource labels to include when
+// exporting the passed-in GCP metric to Prometheus.  Returns `nil` if no
+// ResourceLabel rule matches the metric, meaning that all resource labels
+// should be included.  Otherwise returns a non-nil (possibly empty) slice.
+//
+func (mm *MetricMatcher) ResourceLabels() []string {
+	var labels []string
+	for _, s := range mm.conf.ResourceLabel {
+		if mm.matches(s.For) {
+			if nil == labels {
+				labels = make([]string, 0, len(s.ResourceLabels))
+			}
+			labels = append(labels, s.ResourceLabels...)
+		}
+	}
+	return labels
+}
+
 // Returns the label names to be dropped when exporting the passed-in
 // GCP metric to Prometheus.
 //
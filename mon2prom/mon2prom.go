@@ -5,6 +5,7 @@ The mon2prom package supports reading TimeSeries metric values from GCP
 package mon2prom
 
 import (
+	"math"
 	"math/rand"
 	"sync"
 	"sync/atomic"
@@ -46,7 +47,8 @@ type PromVector struct {
 	MetricKind   mon.MetricKind // 'D'elta, 'G'auge, or 'C'ounter
 	ValueType    mon.ValueType  // Histogram, Int, Float, or Bool
 	details      *ForHumans
-	scaler       func(float64) float64
+	scaler       func(float64) float64 // Unit scaling (for values and bounds)
+	rounder      func(float64) float64 // Any rounding of exported values
 	BucketOpts   *sd.BucketOptions
 	BucketBounds []float64 // Boundaries between hist buckets
 	SubBuckets   []int     // Count of SD buckets in each Prom one.
@@ -122,7 +124,12 @@ func basicPromVec(
 	pv.MetricKind = matcher.Kind
 	pv.ValueType = matcher.Type
 	pv.details.Unit = matcher.Unit
+	if key := matcher.ScaleKey(); "" != key {
+		lager.Debug().MMap("Scaling metric values",
+			"metric", md.Type, "unit", matcher.Unit, "scale", key)
+	}
 	pv.scaler, pv.details.Scale = matcher.Scaler()
+	pv.rounder = matcher.Rounder()
 	if mon.TString == pv.ValueType {
 		return nil, nil // Prometheus does not support string metrics.
 	}
@@ -143,6 +150,13 @@ func (pv *PromVector) addTimeSeriesDetails(
 ) bool {
 	hasProjectID := false
 	resourceKeys := make(map[string]bool)
+	var include map[string]bool // nil means include all resource labels
+	if keep := matcher.ResourceLabels(); nil != keep {
+		include = make(map[string]bool, len(keep))
+		for _, k := range keep {
+			include[k] = true
+		}
+	}
 	pv.details.MonCount = len(tss)
 	for _, ts := range tss {
 		if mon.THist == pv.ValueType && nil == pv.BucketOpts &&
@@ -153,6 +167,9 @@ func (pv *PromVector) addTimeSeriesDetails(
 				display.BucketInfo(val)
 		}
 		for k := range ts.Resource.Labels {
+			if nil != include && !include[k] {
+				continue
+			}
 			resourceKeys[k] = true
 			if "project_id" == k {
 				hasProjectID = true
@@ -238,17 +255,25 @@ func parseBucketOptions(
 	} else if lb := bucketOptions.LinearBuckets; nil != lb {
 		boundCount = 1 + lb.NumFiniteBuckets
 		firstBound = lb.Offset
-		nextBound = func(b float64) float64 { return b + lb.Width }
+		width := lb.Width
+		if nil != scaler {
+			// Bounds are generated from the scaled first bound:
+			width = scaler(lb.Offset+lb.Width) - scaler(lb.Offset)
+		}
+		nextBound = func(b float64) float64 { return b + width }
 	} else if eb := bucketOptions.ExplicitBuckets; nil != eb {
 		boundCount = int64(len(eb.Bounds))
 		firstBound = eb.Bounds[0]
+		bounds := eb.Bounds
 		if nil != scaler {
+			// Scale a copy so the caller's BucketOptions are left intact:
+			bounds = make([]float64, len(eb.Bounds))
 			for i, b := range eb.Bounds {
-				eb.Bounds[i] = scaler(b)
+				bounds[i] = scaler(b)
 			}
 		}
 		i := 0
-		nextBound = func(_ float64) float64 { i++; return eb.Bounds[i] }
+		nextBound = func(_ float64) float64 { i++; return bounds[i] }
 	} else {
 		lager.Fail().Map(
 			"Buckets were not exponential, linear, nor explicit for",
@@ -269,16 +294,22 @@ func (pv *PromVector) resampleHist(
 	lager.Debug().Map("minBuckets", minBuckets, "minBound", minBound,
 		"minRatio", minRatio, "maxBound", maxBound, "maxBuckets", maxBuckets)
 
-	boundCount, firstBound, nextBound := parseBucketOptions(
-		pv.MonDesc.Type, dv.BucketOptions, pv.scaler)
-	if nil == nextBound {
+	var bounds []float64
+	var subBuckets []int
+	ok := false
+	if layout := matcher.BucketLayout(); nil != layout {
+		lager.Debug().Map("Using bucket layout", layout)
+		bounds, subBuckets, ok = layoutBounds(
+			pv.MonDesc.Type, dv.BucketOptions, pv.scaler, layout)
+	} else {
+		bounds, subBuckets, ok = resampleBounds(
+			pv.MonDesc.Type, dv.BucketOptions, pv.scaler,
+			minBuckets, minBound, minRatio, maxBound)
+	}
+	if !ok {
 		return false
 	}
-
-	pv.BucketBounds, pv.SubBuckets = combineBucketBoundaries(
-		boundCount, firstBound, nextBound,
-		minBuckets, minBound, minRatio, maxBound,
-	)
+	pv.BucketBounds, pv.SubBuckets = bounds, subBuckets
 	lager.Debug().Map("bounds", pv.BucketBounds,
 		"subBuckets", pv.SubBuckets)
 
@@ -291,6 +322,111 @@ func (pv *PromVector) resampleHist(
 	return true
 }
 
+// Parses the GCP bucket options and combines the buckets per the limits.
+// Returns false if the bucket options could not be parsed.
+//
+func resampleBounds(
+	name string,
+	bucketOptions *sd.BucketOptions,
+	scaler func(float64) float64,
+	minBuckets int,
+	minBound,
+	minRatio,
+	maxBound float64,
+) ([]float64, []int, bool) {
+	boundCount, firstBound, nextBound := parseBucketOptions(
+		name, bucketOptions, scaler)
+	if nil == nextBound {
+		return nil, nil, false
+	}
+	bounds, subBuckets := combineBucketBoundaries(
+		boundCount, firstBound, nextBound,
+		minBuckets, minBound, minRatio, maxBound,
+	)
+	return bounds, subBuckets, true
+}
+
+// Parses the GCP bucket options and maps the buckets onto the fixed
+// 'layout' boundaries.  Each GCP bucket goes into the first layout bucket
+// whose boundary is not below the GCP bucket's upper boundary, so some
+// layout buckets may get no GCP buckets (a 0 in the returned counts).  GCP
+// buckets above the last layout boundary go into the +Inf bucket.  Returns
+// false if the bucket options could not be parsed.
+//
+func layoutBounds(
+	name string,
+	bucketOptions *sd.BucketOptions,
+	scaler func(float64) float64,
+	layout []float64,
+) ([]float64, []int, bool) {
+	boundCount, bound, nextBound := parseBucketOptions(
+		name, bucketOptions, scaler)
+	if nil == nextBound {
+		return nil, nil, false
+	}
+	// Allow for rounding errors from scaling, like 0.001*3 vs 0.003:
+	const slop = 1e-9
+	subBuckets := make([]int, len(layout))
+	o := 0
+	for i := int64(0); i < boundCount; i++ {
+		if 0 < i {
+			bound = nextBound(bound)
+		}
+		for o < len(layout) &&
+			layout[o] < bound-slop*math.Abs(layout[o]) {
+			o++
+		}
+		if o < len(layout) {
+			subBuckets[o]++
+		}
+	}
+	bounds := make([]float64, len(layout))
+	copy(bounds, layout)
+	return bounds, subBuckets, true
+}
+
+// ResampleDistribution() applies the same histogram resampling that is
+// used when exporting a GCP distribution metric to Prometheus, without
+// needing a MetricDescriptor nor a configuration file.  This makes it easy
+// to try out different HistogramLimits settings against sample data.
+//
+// 'scale' is optional (can be 'nil') and is applied to the bucket bounds.
+// The returned 'bounds' are the finite Prometheus bucket upper bounds and
+// 'counts' holds the (non-cumulative) hits for each of those buckets plus
+// a final entry for the +Inf bucket.
+//
+// 'dropped' is true if 'maxBuckets' is non-zero and the resampled
+// histogram would still have more than 'maxBuckets' buckets, in which case
+// the metric would not be exported (but 'bounds' and 'counts' are still
+// returned).  'dropped' is also true if the bucket options could not be
+// parsed, in which case 'bounds' and 'counts' are 'nil'.  The passed-in
+// 'dist' is not modified.
+//
+func ResampleDistribution(
+	dist *sd.Distribution,
+	minBuckets int,
+	minBound,
+	minRatio,
+	maxBound float64,
+	maxBuckets int,
+	scale config.ScalingFunc,
+) (bounds []float64, counts []uint64, dropped bool) {
+	if nil == dist || nil == dist.BucketOptions {
+		return nil, nil, true
+	}
+	bounds, subBuckets, ok := resampleBounds(
+		"", dist.BucketOptions, scale,
+		minBuckets, minBound, minRatio, maxBound)
+	if !ok || 0 == len(subBuckets) {
+		return nil, nil, true
+	}
+	hist := value.RwHistogram{}
+	hist.Convert(subBuckets, dist)
+	counts = hist.BucketHits
+	dropped = 0 != maxBuckets && maxBuckets < len(bounds)
+	return
+}
+
 // Initializes the Prometheus histogram buckets based on bucket boundaries
 // from a GCP metric and an optional configuration meant to reduce the number
 // of buckets.
@@ -411,12 +547,13 @@ func (pv *PromVector) Collect(ch chan<- prom.Metric) {
 		lager.Note().MMap("Prometheus scraped our metrics for the first time")
 	})
 	for runelist, m := range pv.ReadOnlyMap() {
-		ch <- value.Writer{
-			PDesc: pv.PromDesc,
-			Metric: m.Export(
-				pv.MetricKind, pv.ValueType, &pv.Set, runelist, pv.BucketBounds,
-			),
+		metric := m.Export(
+			pv.MetricKind, pv.ValueType, &pv.Set, runelist, pv.BucketBounds,
+		)
+		if nil != pv.rounder {
+			value.Round(&metric, pv.rounder)
 		}
+		ch <- value.Writer{PDesc: pv.PromDesc, Metric: metric}
 	}
 }
 
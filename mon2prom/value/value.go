@@ -216,6 +216,23 @@ func (hv *Histogram) Export(
 	return m
 }
 
+// Round() applies 'round' to the value of an Export()ed metric (the sum, for
+// a histogram).  This is done only when exporting so that values are
+// accumulated (for DELTA metrics and histogram sums) without rounding.
+//
+func Round(m *dto.Metric, round func(float64) float64) {
+	if nil != m.Gauge {
+		m.Gauge.Value = proto.Float64(round(m.Gauge.GetValue()))
+	}
+	if nil != m.Counter {
+		m.Counter.Value = proto.Float64(round(m.Counter.GetValue()))
+	}
+	if nil != m.Histogram {
+		m.Histogram.SampleSum = proto.Float64(
+			round(m.Histogram.GetSampleSum()))
+	}
+}
+
 // Convert() converts a GCP Distribution value into a Prometheus histogram
 // value which is then added to the invoking value.RwHistogram.  The sum of
 // the (new) observations is returned so the caller can scale it and then add
@@ -232,12 +249,11 @@ func (hv *RwHistogram) Convert(
 	o := 0
 	subs := subBuckets[0]
 	for _, n := range dv.BucketCounts {
-		if 0 == subs {
+		// Skip past any Prom buckets that hold no GCP buckets:
+		for 0 == subs && o < len(subBuckets) {
 			o++
 			if o < len(subBuckets) {
 				subs = subBuckets[o]
-			} else {
-				subs = 0
 			}
 		}
 		subs--
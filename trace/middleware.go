@@ -0,0 +1,208 @@
+package trace
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	spans "github.com/Unity-Technologies/go-lager-internal/gcp-spans"
+	rpc "google.golang.org/genproto/googleapis/rpc/code"
+)
+
+// Middleware() returns a function that wraps an http.Handler so that each
+// request gets a server span registered via 'reg' (which must not be 'nil').
+//
+// The trace context is imported from the request headers [see
+// ImportFromHeaders()] so the new span continues the caller's trace (a new
+// trace is started if the header is missing or invalid).  The span is
+// named from the request method and URL path (like "GET /users/123") and is
+// stored in the request's Context [see spans.ContextStoreSpan()] so the
+// handler can use ContextPushSpan() or PushSpan() to create sub-spans.
+//
+// The URL path (never the query string, which can hold secrets) is recorded
+// as AttrHTTPURL.  The ResponseWriter passed to the handler supports
+// http.Flusher, http.Hijacker, and http.Pusher only if the original one
+// does.
+//
+// When the handler returns, the response status is recorded via
+// SetHTTPServer() and the span is Finish()ed.  The route is only recorded
+// (as AttrHTTPRoute) if the WithRoute() option is passed.
+//
+// If the handler panics, then the span's status code is set to INTERNAL
+// with a message giving the panic value and the handler's stack trace, the
+// span is Finish()ed, and then the panic is resumed.  A panic with
+// http.ErrAbortHandler (which just aborts the response) sets the ABORTED
+// status code instead.
+//
+// Example usage:
+//
+//      mux := http.NewServeMux()
+//      ...
+//      srv := &http.Server{Handler: trace.Middleware(reg)(mux)}
+//
+func Middleware(
+	reg *Registrar, opts ...MiddlewareOption,
+) func(http.Handler) http.Handler {
+	var conf middlewareConf
+	for _, opt := range opts {
+		opt(&conf)
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			sp, ok := reg.NewFactory().ImportFromHeaders(req.Header).
+				NewSpan().(*Span)
+			if !ok {
+				next.ServeHTTP(rw, req)
+				return
+			}
+			sp.SetIsServer().SetDisplayName(req.Method + " " + req.URL.Path)
+			sp.addAttribute(AttrHTTPURL, req.URL.Path, false)
+			route := ""
+			if nil != conf.route {
+				route = conf.route(req)
+			}
+			sw := &statusWriter{ResponseWriter: rw}
+			defer func() {
+				p := recover()
+				if nil == p {
+					sp.SetHTTPServer(req.Method, route, sw.statusOr(200))
+					sp.Finish()
+					return
+				}
+				if http.ErrAbortHandler == p {
+					sp.SetHTTPServer(req.Method, route, sw.statusOr(0))
+					sp.setStatusCode(int64(rpc.Code_ABORTED))
+					sp.SetStatusMessage("response aborted")
+				} else {
+					// The handler's frames are still on the stack here:
+					sp.SetHTTPServer(req.Method, route, sw.statusOr(500))
+					sp.setStatusCode(int64(rpc.Code_INTERNAL))
+					sp.SetStatusMessage(
+						fmt.Sprintf("panic: %v\n%s", p, debug.Stack()))
+				}
+				sp.Finish()
+				panic(p)
+			}()
+			ctx := spans.ContextStoreSpan(req.Context(), sp)
+			next.ServeHTTP(sw.wrap(), req.WithContext(ctx))
+		})
+	}
+}
+
+// MiddlewareOption is an optional argument to Middleware().
+type MiddlewareOption func(*middlewareConf)
+
+// middlewareConf holds the settings from the MiddlewareOptions.
+type middlewareConf struct {
+	route func(*http.Request) string
+}
+
+// WithRoute() returns a MiddlewareOption that records the route returned
+// by 'route' (such as "/users/{id}") for each request as AttrHTTPRoute.
+// 'route' is called before the handler with the incoming request and can
+// return "" to not record a route.
+//
+func WithRoute(route func(*http.Request) string) MiddlewareOption {
+	return func(mc *middlewareConf) { mc.route = route }
+}
+
+// statusWriter is an http.ResponseWriter that remembers the response
+// status so Middleware() can record it on the server span.
+//
+type statusWriter struct {
+	http.ResponseWriter
+	status int // 0 until WriteHeader() or Write() is called
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if 0 == sw.status {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if 0 == sw.status {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+// wrap() returns 'sw' as an http.ResponseWriter that also implements
+// each of http.Flusher, http.Hijacker, and http.Pusher that the wrapped
+// ResponseWriter implements (and no others), so handlers that check for
+// those interfaces see the same answer as without Middleware().
+//
+func (sw *statusWriter) wrap() http.ResponseWriter {
+	_, isF := sw.ResponseWriter.(http.Flusher)
+	h, isH := sw.ResponseWriter.(http.Hijacker)
+	p, isP := sw.ResponseWriter.(http.Pusher)
+	f := statusFlusher{sw}
+	switch {
+	case isF && isH && isP:
+		return struct {
+			statusFlusher
+			http.Hijacker
+			http.Pusher
+		}{f, h, p}
+	case isF && isH:
+		return struct {
+			statusFlusher
+			http.Hijacker
+		}{f, h}
+	case isF && isP:
+		return struct {
+			statusFlusher
+			http.Pusher
+		}{f, p}
+	case isF:
+		return f
+	case isH && isP:
+		return struct {
+			*statusWriter
+			http.Hijacker
+			http.Pusher
+		}{sw, h, p}
+	case isH:
+		return struct {
+			*statusWriter
+			http.Hijacker
+		}{sw, h}
+	case isP:
+		return struct {
+			*statusWriter
+			http.Pusher
+		}{sw, p}
+	}
+	return sw
+}
+
+// statusFlusher is a statusWriter for a ResponseWriter that supports
+// http.Flusher, so streaming handlers still work.
+//
+type statusFlusher struct {
+	*statusWriter
+}
+
+func (sf statusFlusher) Flush() {
+	if 0 == sf.status {
+		sf.status = http.StatusOK
+	}
+	sf.ResponseWriter.(http.Flusher).Flush()
+}
+
+// Unwrap() returns the wrapped ResponseWriter (used by
+// http.ResponseController in newer versions of Go).
+//
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// statusOr() returns the recorded status or 'tacit' if none was written.
+//
+func (sw *statusWriter) statusOr(tacit int) int {
+	if 0 == sw.status {
+		return tacit
+	}
+	return sw.status
+}
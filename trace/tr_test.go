@@ -1,11 +1,20 @@
 package trace
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -13,6 +22,14 @@ import (
 	"github.com/Unity-Technologies/go-lager-internal/buffer"
 	"github.com/Unity-Technologies/go-lager-internal/gcp-spans"
 	"github.com/Unity-Technologies/go-tutl-internal"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	ct2 "google.golang.org/api/cloudtrace/v2"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 func TestTrace(t *testing.T) {
@@ -101,7 +118,7 @@ func TestTrace(t *testing.T) {
 	sp := empty.NewSpan()
 	sp.SetHeader(fakeHead)
 	inHead := sp
-	u.Is(sp.GetCloudContext(), fakeHead.Get(spans.TraceHeader),
+	u.Is(sp.GetCloudContext()+";o=1", fakeHead.Get(spans.TraceHeader),
 		"SetHeader sets "+spans.TraceHeader)
 	u.Is("", logs.ReadAll(), "logs nothing 2")
 	if u.IsNot(nil, sp, "empty NewSpan") {
@@ -151,6 +168,8 @@ func TestTrace(t *testing.T) {
 		"AddAttribute[(][)]", "'key' must not be empty string")
 	u.Is(nil, sub.AddAttribute("response_bytes", 407), "AddAttrib bytes err")
 	sub.SetStatusCode(404)
+	u.Like(logs.ReadAll(), "HTTP status code warns",
+		"SetStatusCode[(][)]", "SetHTTPStatus[(][)]")
 	sub.SetStatusMessage("Not found")
 
 	// Simulate sp.kidSpan wrapping through 0:
@@ -396,3 +415,2088 @@ func TestTrace(t *testing.T) {
 		"RequestPushSpan[(][)]", "passed nil Request", `"_stack":`)
 
 }
+
+// fakeTrace is a stand-in for the CloudTrace API so that tests can run
+// without GCP credentials.  'status' is the HTTP status to respond with.
+//
+type fakeTrace struct {
+	mu      sync.Mutex
+	status  int
+	delay   time.Duration
+	batches [][]*ct2.Span
+	srv     *httptest.Server
+}
+
+func newFakeTrace() *fakeTrace {
+	ft := &fakeTrace{status: 200}
+	ft.srv = httptest.NewServer(http.HandlerFunc(
+		func(rw http.ResponseWriter, req *http.Request) {
+			var batch ct2.BatchWriteSpansRequest
+			_ = json.NewDecoder(req.Body).Decode(&batch)
+			ft.mu.Lock()
+			ft.batches = append(ft.batches, batch.Spans)
+			status, delay := ft.status, ft.delay
+			ft.mu.Unlock()
+			time.Sleep(delay)
+			rw.Header().Set("Content-Type", "application/json")
+			rw.WriteHeader(status)
+			rw.Write([]byte("{}"))
+		},
+	))
+	return ft
+}
+
+func (ft *fakeTrace) client() Client {
+	svc, err := ct2.NewService(context.Background(),
+		option.WithEndpoint(ft.srv.URL+"/"), option.WithoutAuthentication())
+	if nil != err {
+		panic(err)
+	}
+	return Client{ts: ct2.NewProjectsTracesService(svc)}
+}
+
+func (ft *fakeTrace) setStatus(status int) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	ft.status = status
+}
+
+func (ft *fakeTrace) setDelay(delay time.Duration) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	ft.delay = delay
+}
+
+// spans() returns all of the spans written so far.
+func (ft *fakeTrace) spans() []*ct2.Span {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	all := make([]*ct2.Span, 0)
+	for _, b := range ft.batches {
+		all = append(all, b...)
+	}
+	return all
+}
+
+// fakeRegistrar() returns a Registrar with a single runner that writes
+// spans to a fakeTrace.  Call the returned func to Halt() it (it is also
+// called when the test ends).  'envPairs' are environment variable names
+// and values that override the defaults used here.  The environment is
+// restored when the test ends.
+//
+func fakeRegistrar(
+	t *testing.T, ft *fakeTrace, envPairs ...string,
+) (*Registrar, func()) {
+	t.Setenv("SPAN_RUNNERS", "1")
+	t.Setenv("SPAN_QUEUE_CAPACITY", "100")
+	t.Setenv("SPAN_BATCH_SIZE", "100")
+	t.Setenv("SPAN_BATCH_BYTES", "1000000")
+	t.Setenv("SPAN_BATCH_DUR", "1s")
+	t.Setenv("SPAN_CREATE_TIMEOUT", "1s")
+	t.Setenv("SPAN_SAMPLE_RATE", "1")
+	t.Setenv("SPAN_BATCH_JITTER_MIN", "1")
+	t.Setenv("SPAN_BATCH_JITTER_MAX", "1.5")
+	for i := 0; i+1 < len(envPairs); i += 2 {
+		t.Setenv(envPairs[i], envPairs[i+1])
+	}
+	reg, err := NewRegistrar("fake-proj", ft.client())
+	if nil != err {
+		t.Fatal(err)
+	}
+	halt := func() { reg.Halt(); ft.srv.Close() }
+	t.Cleanup(halt)
+	return reg, halt
+}
+
+// fakeSetup() does the setup that most tests need: it captures logs, and
+// creates a fakeTrace and a Registrar that writes to it [see
+// fakeRegistrar(), which is passed 'envPairs'].  The logs are restored and
+// the Registrar is halted when the test ends.
+//
+func fakeSetup(
+	t *testing.T, envPairs ...string,
+) (tutl.TUTL, *buffer.AsyncBuffer, *fakeTrace, *Registrar) {
+	logs := new(buffer.AsyncBuffer)
+	t.Cleanup(lager.SetOutput(logs))
+	ft := newFakeTrace()
+	reg, _ := fakeRegistrar(t, ft, envPairs...)
+	return tutl.New(t), logs, ft, reg
+}
+
+func counterValue(c interface{ Write(*dto.Metric) error }) float64 {
+	var m dto.Metric
+	if err := c.Write(&m); nil != err {
+		panic(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func sampleCount(o prometheus.Observer) uint64 {
+	var m dto.Metric
+	if err := o.(prometheus.Metric).Write(&m); nil != err {
+		panic(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestInvalidSpans(t *testing.T) {
+	u := tutl.New(t)
+	logs := new(buffer.AsyncBuffer)
+	defer lager.SetOutput(logs)()
+	invalidMu.Lock()
+	invalidWarned = make(map[invalidKey]time.Time)
+	invalidMu.Unlock()
+
+	u.Is("", invalidReason(&ct2.Span{SpanId: "1",
+		DisplayName: &ct2.TruncatableString{Value: "ok"},
+		StartTime:   "2022-06-01T12:00:00.1Z",
+		EndTime:     "2022-06-01T12:00:00.2Z"}), "valid span")
+	u.Is("no_span_id", invalidReason(&ct2.Span{}), "no span ID")
+	u.Is("no_start", invalidReason(&ct2.Span{SpanId: "1",
+		DisplayName: &ct2.TruncatableString{Value: "ok"}}), "no start")
+	u.Is("bad_end", invalidReason(&ct2.Span{SpanId: "1",
+		DisplayName: &ct2.TruncatableString{Value: "ok"},
+		StartTime:   "2022-06-01T12:00:00Z", EndTime: "noon"}), "bad end")
+
+	ft := newFakeTrace()
+	reg, _ := fakeRegistrar(t, ft)
+	counter := spansInvalid.WithLabelValues(reg.domain, "end_before_start")
+	before := counterValue(counter)
+
+	bad := reg.NewFactory().NewSpan().SetDisplayName("backwards")
+	bad.(*Span).details.StartTime = TimeAsString(time.Now().Add(time.Hour))
+	good := bad.NewSpan().SetDisplayName("forwards")
+	good.Finish()
+	bad.Finish()
+	reg.WaitForIdleRunners()
+
+	written := ft.spans()
+	if u.Is(1, len(written), "only valid span written") {
+		u.Is("forwards", written[0].DisplayName.Value, "valid span name")
+	}
+	u.Is(before+1, counterValue(counter), "invalid span counted")
+	u.Like(logs.ReadAll(), "invalid span logs",
+		"*dropped invalid span", `"reason":"end_before_start"`)
+
+	bad = reg.NewFactory().NewSpan().SetDisplayName("backwards2")
+	bad.(*Span).details.StartTime = TimeAsString(time.Now().Add(time.Hour))
+	bad.Finish()
+	reg.WaitForIdleRunners()
+	u.Is(before+2, counterValue(counter), "2nd invalid span counted")
+	u.Is("", logs.ReadAll(), "2nd invalid span warning suppressed")
+}
+
+func TestExplicitTimes(t *testing.T) {
+	u, logs, ft, reg := fakeSetup(t)
+
+	start := time.Now().Add(-2 * time.Hour).Truncate(time.Microsecond)
+	end := start.Add(90 * time.Second)
+	sp := reg.NewFactory().NewSpan().SetDisplayName("replayed")
+	sp.(*Span).SetStartTime(start)
+	u.Is(start, sp.GetStart(), "GetStart after SetStartTime")
+	u.Is(90*time.Second, sp.(*Span).FinishAt(end), "FinishAt duration")
+	u.Is(90*time.Second, sp.GetDuration(), "GetDuration after FinishAt")
+	reg.WaitForIdleRunners()
+	u.Is("", logs.ReadAll(), "back-dated span logs nothing")
+
+	written := ft.spans()
+	if u.Is(1, len(written), "back-dated span written") {
+		u.Is(TimeAsString(start), written[0].StartTime, "written start")
+		u.Is(TimeAsString(end), written[0].EndTime, "written end")
+	}
+
+	sp = reg.NewFactory().NewSpan().SetDisplayName("backwards")
+	u.Is(time.Duration(0), sp.(*Span).FinishAt(sp.GetStart().Add(-time.Second)),
+		"FinishAt before start")
+	u.Like(logs.ReadAll(), "FinishAt before start logs",
+		"FinishAt[(][)]", "*before start", `"_stack":`)
+	u.Is(-time.Second, sp.GetDuration(), "rejected FinishAt did not finish")
+
+	sp.(*Span).SetStartTime(time.Time{})
+	u.Like(logs.ReadAll(), "SetStartTime zero logs",
+		"SetStartTime[(][)]", "*zero time")
+	u.IsNot(time.Time{}, sp.GetStart(), "zero start time ignored")
+	sp.Finish()
+}
+
+type attrKey string
+
+func (k attrKey) String() string { return "app." + string(k) }
+
+func TestPairKeys(t *testing.T) {
+	u, logs, _, reg := fakeSetup(t)
+
+	sp := reg.NewFactory().NewSpan()
+	sp.AddPairs(attrKey("user"), "alice", "plain", "yes")
+	u.Is("", logs.ReadAll(), "Stringer and string keys log nothing")
+	attrs := sp.(*Span).details.Attributes.AttributeMap
+	u.Is(2, len(attrs), "keys after AddPairs()")
+	u.Is("alice", attrs["app.user"].StringValue.Value, "Stringer key")
+	u.Is("yes", attrs["plain"].StringValue.Value, "string key")
+
+	sp.AddPairs(42, "value")
+	u.Like(logs.ReadAll(), "int key logs",
+		"*non-string key", `"key":42,`, `"type":"int",`)
+	sp.AddPairs("", "value")
+	u.Like(logs.ReadAll(), "empty key logs",
+		"*error adding attribute", "'key' must not be empty string")
+	u.Is(2, len(attrs), "invalid keys not added")
+	sp.Finish()
+}
+
+func TestCreateMetricLabels(t *testing.T) {
+	u, logs, ft, reg := fakeSetup(t,
+		"SPAN_BATCH_SIZE", "2", "SPAN_CREATE_TIMEOUT", "0.1s")
+
+	okSize := spanCreateSeconds.WithLabelValues("fake-proj", "size", "ok")
+	okFlush := spanCreateSeconds.WithLabelValues("fake-proj", "flush", "ok")
+	timedOut := spanCreateSeconds.WithLabelValues(
+		"fake-proj", "flush", "deadline")
+	wasSize, wasFlush, wasTimeout :=
+		sampleCount(okSize), sampleCount(okFlush), sampleCount(timedOut)
+
+	sp := reg.NewFactory().NewSpan()
+	sp.NewSpan().Finish()
+	sp.Finish()
+	reg.WaitForIdleRunners()
+	u.Is(wasSize+1, sampleCount(okSize), "full batch recorded as size/ok")
+
+	reg.NewFactory().NewSpan().Finish()
+	reg.WaitForIdleRunners()
+	u.Is(wasFlush+1, sampleCount(okFlush), "flushed batch recorded")
+
+	ft.setDelay(time.Second / 2)
+	reg.NewFactory().NewSpan().Finish()
+	reg.WaitForIdleRunners()
+	u.Is(wasTimeout+1, sampleCount(timedOut), "slow batch recorded as deadline")
+	u.Is(wasFlush+1, sampleCount(okFlush), "slow batch not recorded as ok")
+	u.Is("", logs.ReadAll(), "no failures logged")
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestWriteResult(t *testing.T) {
+	u := tutl.New(t)
+	bg := context.Background()
+	expired, can := context.WithTimeout(bg, 0)
+	defer can()
+	canceled, cancel := context.WithCancel(bg)
+	cancel()
+	apiErr := &googleapi.Error{Code: 503}
+
+	u.Is("ok", writeResult(bg, nil), "nil error")
+	u.Is("deadline", writeResult(expired, errors.New("x")), "ctx deadline")
+	u.Is("deadline", writeResult(bg,
+		fmt.Errorf("wrap: %w", context.DeadlineExceeded)), "wrapped deadline")
+	u.Is("canceled", writeResult(canceled, errors.New("x")), "ctx canceled")
+	u.Is("canceled", writeResult(bg,
+		fmt.Errorf("wrap: %w", context.Canceled)), "wrapped canceled")
+	u.Is("transport", writeResult(bg, errors.New("dial")), "no HTTP status")
+	u.Is("fail", writeResult(bg, apiErr), "HTTP error status")
+	u.Is("deadline", writeResult(expired, apiErr), "deadline beats status")
+
+	logs := new(buffer.AsyncBuffer)
+	defer lager.SetOutput(logs)()
+	created := func(result string) prometheus.Observer {
+		return spanCreateSeconds.WithLabelValues(
+			"fake-proj", "flush", result)
+	}
+	write := func(reg *Registrar) {
+		reg.NewFactory().NewSpan().Finish()
+		reg.WaitForIdleRunners()
+	}
+
+	ft := newFakeTrace()
+	reg, halt := fakeRegistrar(t, ft,
+		"SPAN_BATCH_DUR", "0.01s", "SPAN_CREATE_TIMEOUT", "0.1s")
+	was := sampleCount(created("deadline"))
+	ft.setDelay(time.Second / 2)
+	write(reg)
+	u.Is(was+1, sampleCount(created("deadline")), "slow service")
+	u.Is("", logs.ReadAll(), "deadline not logged")
+
+	was = sampleCount(created("fail"))
+	ft.setDelay(0)
+	ft.setStatus(500)
+	write(reg)
+	u.Is(was+1, sampleCount(created("fail")), "error status")
+	u.Like(logs.ReadAll(), "failure logged",
+		"Failed to create span batch", `"code":500`, `"result":"fail"`)
+
+	was = sampleCount(created("transport"))
+	ft.srv.Close()
+	write(reg)
+	u.Is(was+1, sampleCount(created("transport")), "unreachable service")
+	u.Like(logs.ReadAll(), "transport failure logged",
+		"Failed to create span batch", `"code":0`, `"result":"transport"`)
+	halt()
+
+	svc, err := ct2.NewService(bg, option.WithEndpoint("http://fake/"),
+		option.WithoutAuthentication(),
+		option.WithHTTPClient(&http.Client{Transport: roundTripFunc(
+			func(*http.Request) (*http.Response, error) {
+				return nil, context.Canceled
+			})}))
+	u.Is(nil, err, "canceling service created")
+	reg, err = NewRegistrar(
+		"fake-proj", Client{ts: ct2.NewProjectsTracesService(svc)})
+	u.Is(nil, err, "canceling registrar created")
+	was = sampleCount(created("canceled"))
+	write(reg)
+	u.Is(was+1, sampleCount(created("canceled")), "canceled request")
+	u.Is("", logs.ReadAll(), "cancel not logged")
+	reg.Halt()
+}
+
+func TestSampling(t *testing.T) {
+	u, logs, ft, reg := fakeSetup(t)
+	sp := reg.NewFactory().NewSpan()
+	u.Is(true, sp.(*Span).IsSampled(), "sampled by default")
+	u.Is(true, sp.NewSpan().(*Span).IsSampled(), "sub-span sampled")
+	u.Is(false, reg.NewFactory().(*Span).IsSampled(), "empty not sampled")
+	sp.Finish()
+	reg.WaitForIdleRunners()
+	u.Is(1, len(ft.spans()), "sampled span written")
+
+	// An upstream "o=0" decision is honored and passed on:
+	const upstream = "0123456789abcdef0123456789abcdef/5"
+	head := http.Header{spans.TraceHeader: {upstream + ";o=0"}}
+	im := reg.NewFactory().ImportFromHeaders(head)
+	u.Is(uint64(5), im.GetSpanID(), "import with o=0")
+	kid := im.NewSpan()
+	u.Is(false, kid.(*Span).IsSampled(), "o=0 sub-span not sampled")
+	out := make(http.Header)
+	kid.SetHeader(out)
+	u.Like(out.Get(spans.TraceHeader), "o=0 passed on", "/[0-9]+;o=0$")
+	kid.Finish()
+	head.Set(spans.TraceHeader, upstream+";o=1")
+	im = reg.NewFactory().ImportFromHeaders(head)
+	u.Is(true, im.NewSpan().(*Span).IsSampled(), "o=1 sub-span sampled")
+	reg.WaitForIdleRunners()
+	u.Is(1, len(ft.spans()), "o=0 sub-span not written")
+	reg.Halt()
+
+	ft = newFakeTrace()
+	reg, _ = fakeRegistrar(t, ft, "SPAN_SAMPLE_RATE", "0")
+	sp = reg.NewFactory().NewSpan()
+	kid = sp.NewSpan()
+	u.Is(false, sp.(*Span).IsSampled(), "rate 0 not sampled")
+	u.Is(false, kid.(*Span).IsSampled(), "rate 0 sub-span not sampled")
+	kid.Finish()
+	u.Is(true, 0 <= sp.Finish(), "unsampled Finish() gives duration")
+	reg.WaitForIdleRunners()
+	u.Is(0, len(ft.spans()), "unsampled spans not written")
+
+	// An upstream "o=1" decision overrides SPAN_SAMPLE_RATE:
+	head.Set(spans.TraceHeader, upstream+";o=1")
+	kid = reg.NewFactory().ImportFromHeaders(head).NewSpan()
+	u.Is(true, kid.(*Span).IsSampled(), "o=1 overrides rate 0")
+	out = make(http.Header)
+	kid.SetHeader(out)
+	u.Like(out.Get(spans.TraceHeader), "o=1 passed on", "/[0-9]+;o=1$")
+	kid.Finish()
+	reg.WaitForIdleRunners()
+	u.Is(1, len(ft.spans()), "o=1 sub-span written")
+	head.Set(spans.TraceHeader, upstream)
+	kid = reg.NewFactory().ImportFromHeaders(head).NewSpan()
+	u.Is(false, kid.(*Span).IsSampled(), "no option uses rate 0")
+	u.Is("", logs.ReadAll(), "sampling logs nothing")
+
+	t.Setenv("SPAN_SAMPLE_RATE", "1.5")
+	_, err := NewRegistrar("fake-proj", ft.client())
+	u.Like(err, "invalid sample rate", "SPAN_SAMPLE_RATE", "between")
+
+	ev := "TEST_ENV_FLOAT"
+	u.Is(0.5, EnvFloat(0.5, ev), "envfloat default")
+	t.Setenv(ev, "0.25")
+	u.Is(0.25, EnvFloat(0.5, ev), "envfloat from env")
+}
+
+func TestStatusCodes(t *testing.T) {
+	u, logs, _, reg := fakeSetup(t)
+	httpCodeWarnOnce = sync.Once{}
+
+	sp := reg.NewFactory().NewSpan()
+	status := func() int64 { return sp.(*Span).details.Status.Code }
+
+	sp.SetStatusCode(404)
+	u.Is(5, status(), "404 -> NOT_FOUND")
+	u.Like(logs.ReadAll(), "HTTP status code warns",
+		"*http status passed", "SetHTTPStatus[(][)]", `"status":404`)
+	sp.SetStatusCode(200)
+	u.Is(0, status(), "200 -> OK")
+	u.Is("", logs.ReadAll(), "HTTP status code warns only once")
+	sp.SetStatusCode(5)
+	u.Is(5, status(), "canonical NOT_FOUND unchanged")
+	sp.SetStatusCode(16)
+	u.Is(16, status(), "canonical UNAUTHENTICATED unchanged")
+	sp.(*Span).SetHTTPStatus(503)
+	u.Is(14, status(), "SetHTTPStatus 503 -> UNAVAILABLE")
+	u.Is("", logs.ReadAll(), "canonical codes log nothing")
+
+	u.Is(13, HTTPStatusToCode(500), "500 -> INTERNAL")
+	u.Is(9, HTTPStatusToCode(418), "418 -> FAILED_PRECONDITION")
+	u.Is(0, HTTPStatusToCode(302), "302 -> OK")
+	sp.Finish()
+}
+
+func TestCorrelation(t *testing.T) {
+	u, logs, _, reg := fakeSetup(t)
+
+	empty := reg.NewFactory().(*Span)
+	u.Is("", empty.GetCorrelation(), "empty correlation")
+
+	sp := empty.NewSpan().(*Span)
+	u.Is("projects/fake-proj/traces/"+sp.GetTraceID()+";"+
+		spans.HexSpanID(sp.GetSpanID()), sp.GetCorrelation(),
+		"live span correlation")
+	sp.Finish()
+
+	im, err := empty.Import("0123456789abcdef0123456789abcdef", 255)
+	u.Is(nil, err, "import error")
+	u.Is("projects/fake-proj/traces/0123456789abcdef0123456789abcdef;"+
+		"00000000000000ff", im.(*Span).GetCorrelation(),
+		"imported span correlation")
+	u.Is("", logs.ReadAll(), "correlation logs nothing")
+}
+
+func TestBatchJitter(t *testing.T) {
+	u := tutl.New(t)
+	logs := new(buffer.AsyncBuffer)
+	defer lager.SetOutput(logs)()
+
+	bc := batchConf{maxBatchDur: time.Second, jitterMin: 1.2, jitterMax: 2}
+	lo, hi := time.Duration(1.2*float64(time.Second)), 2*time.Second
+	for i := 0; i < 10000; i++ {
+		d := bc.flushAfter()
+		if d < lo || hi < d {
+			u.Is(true, false, fmt.Sprintf("flushAfter() %v out of range", d))
+			break
+		}
+	}
+	bc.jitterMax = bc.jitterMin
+	u.Is(lo, bc.flushAfter(), "flushAfter() with no jitter range")
+
+	ft := newFakeTrace()
+	defer ft.srv.Close()
+	for _, pair := range [][2]string{{"0.5", "1.5"}, {"1.5", "1.2"}} {
+		t.Setenv("SPAN_BATCH_JITTER_MIN", pair[0])
+		t.Setenv("SPAN_BATCH_JITTER_MAX", pair[1])
+		_, err := NewRegistrar("fake-proj", ft.client())
+		u.Like(err, "bad jitter "+pair[0]+".."+pair[1],
+			"SPAN_BATCH_JITTER_MIN", "SPAN_BATCH_JITTER_MAX")
+	}
+}
+
+func TestRunnerStagger(t *testing.T) {
+	u := tutl.New(t)
+
+	bc := batchConf{maxBatchDur: time.Second}
+	u.Is(time.Duration(0), bc.runnerPhase(0.0, 0, 4), "no stagger")
+	for i := 0; i < 1000; i++ {
+		prev := time.Duration(-1)
+		for r := 0; r < 4; r++ {
+			p := bc.runnerPhase(0.5, r, 4)
+			lo := time.Duration(r) * time.Second / 8
+			if p < lo || lo+time.Second/8 <= p || p <= prev {
+				u.Is(true, false, fmt.Sprintf(
+					"runner %d phase %v out of order or range", r, p))
+				return
+			}
+			prev = p
+		}
+	}
+	if p := bc.runnerPhase(1.0, 0, 1); p < 0 || time.Second <= p {
+		u.Is(true, false, fmt.Sprintf("full stagger phase %v", p))
+	}
+
+	ft := newFakeTrace()
+	defer ft.srv.Close()
+	for _, bad := range []string{"-0.1", "1.5"} {
+		t.Setenv("SPAN_RUNNER_STAGGER", bad)
+		_, err := NewRegistrar("fake-proj", ft.client())
+		u.Like(err, "bad stagger "+bad, "SPAN_RUNNER_STAGGER", bad)
+	}
+}
+
+func TestRunnerStaggerFlush(t *testing.T) {
+	clock := useFakeClock(t, true)
+	defer clock.release()
+	u, logs, ft, reg := fakeSetup(t,
+		"SPAN_RUNNERS", "4", "SPAN_RUNNER_STAGGER", "1")
+	fact := reg.NewFactory()
+	nextTimer := func() *fakeTimer {
+		select {
+		case tm := <-clock.made:
+			return tm
+		case <-time.After(time.Second):
+			return nil
+		}
+	}
+
+	// Each runner holds in newTimer() after reading its first span, so
+	// each span goes to a different runner:
+	timers := make([]*fakeTimer, 0, 4)
+	durs := make(map[time.Duration]bool)
+	for r := 0; r < 4; r++ {
+		fact.NewSpan().Finish()
+		tm := nextTimer()
+		if !u.Is(true, nil != tm, u.S("runner ", r, " started timer")) {
+			return
+		}
+		u.Is(true, 0 < tm.dur && tm.dur <= time.Second,
+			u.S("first flush after ", tm.dur, " within SPAN_BATCH_DUR"))
+		timers = append(timers, tm)
+		durs[tm.dur] = true
+	}
+	u.Is(4, len(durs), u.S("first flush deadlines differ ", durs))
+	clock.release()
+
+	for _, tm := range timers {
+		u.Is(true, tm.fire(), "runner got timeout")
+	}
+	reg.WaitForIdleRunners()
+	u.Is(4, len(ft.spans()), "each runner wrote its span")
+
+	// Only the first batch of each runner is staggered:
+	fact.NewSpan().Finish()
+	if tm := nextTimer(); u.Is(true, nil != tm, "timer for later batch") {
+		u.Is(true, time.Second <= tm.dur && tm.dur < 1500*time.Millisecond,
+			u.S("later flush after ", tm.dur, " is not staggered"))
+	}
+	reg.Halt()
+	u.Is(5, len(ft.spans()), "later span written by Halt()")
+	u.Is("", logs.ReadAll(), "no logs")
+}
+
+func TestClientTimeout(t *testing.T) {
+	u := tutl.New(t)
+
+	stuck := make(chan struct{})
+	defer close(stuck)
+	orig := newService
+	defer func() { newService = orig }()
+	newService = func(
+		ctx context.Context, opts ...option.ClientOption,
+	) (*ct2.Service, error) {
+		<-stuck
+		return nil, errors.New("credential lookup never finished")
+	}
+
+	ctx, can := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer can()
+	start := time.Now()
+	_, err := NewClient(ctx, nil)
+	u.Like(err, "near-deadline ctx", "Gave up", "credentials", "deadline")
+	u.Is(true, errors.Is(err, context.DeadlineExceeded), "wraps ctx error")
+	u.Is(true, time.Since(start) < time.Second, "caller deadline respected")
+
+	t.Setenv("TRACE_CLIENT_TIMEOUT", "20ms")
+	start = time.Now()
+	_, err = NewClient(nil, nil)
+	u.Like(err, "default deadline", "Timed out", "TRACE_CLIENT_TIMEOUT")
+	u.Is(true, time.Since(start) < time.Second, "default deadline applied")
+
+	newService = func(
+		ctx context.Context, opts ...option.ClientOption,
+	) (*ct2.Service, error) {
+		return ct2.NewService(ctx, option.WithoutAuthentication())
+	}
+	_, err = NewClient(context.Background(), nil)
+	u.Is(nil, err, "quick service creation")
+}
+
+type httpErr int
+
+func (e httpErr) Error() string   { return fmt.Sprintf("HTTP %d", int(e)) }
+func (e httpErr) HTTPStatus() int { return int(e) }
+
+func TestFinishWithError(t *testing.T) {
+	u, logs, _, reg := fakeSetup(t)
+	fact := reg.NewFactory()
+
+	sp := fact.NewSpan().(*Span)
+	u.IsNot(0, sp.FinishWithError(nil), "nil error finishes")
+	u.Is(nil, sp.details.Status, "nil error sets no status")
+	u.Is(time.Duration(0), sp.FinishWithError(nil), "finish twice")
+	u.Like(logs.ReadAll(), "finish twice logs", "Finish[(][)]ed",
+		"FinishWithError")
+
+	sp = fact.NewSpan().SetDisplayName("burn").(*Span)
+	sp.FinishWithError(errors.New("disk on fire"))
+	if u.IsNot(nil, sp.details.Status, "plain error sets status") {
+		u.Is(13, sp.details.Status.Code, "plain error -> INTERNAL")
+		u.Is("disk on fire", sp.details.Status.Message, "plain error message")
+	}
+	log := string(logs.ReadAll())
+	u.Is(1, strings.Count(log, "\n"), "one warning for error")
+	u.Like(log, "error logged", "*span finished with error", `"span":"burn"`,
+		`"code":13`, `"error":"disk on fire"`,
+		`"_file":"module/trace/tr_test.go"`)
+
+	for _, tc := range []struct {
+		err  error
+		code int64
+		desc string
+	}{
+		{status.Error(codes.NotFound, "no row"), 5, "gRPC NOT_FOUND"},
+		{fmt.Errorf("wrapped: %w", status.Error(codes.Aborted, "x")),
+			10, "wrapped gRPC ABORTED"},
+		{status.Error(codes.Unavailable, "busy"), 14, "gRPC UNAVAILABLE"},
+		{httpErr(429), 8, "HTTPStatus() 429"},
+		{httpErr(200), 13, "HTTPStatus() 200 -> INTERNAL"},
+		{&googleapi.Error{Code: 403}, 7, "googleapi 403"},
+	} {
+		u.Is(tc.code, ErrorToCode(tc.err), tc.desc)
+		sp = fact.NewSpan().(*Span)
+		sp.FinishWithError(tc.err)
+		u.Is(tc.code, sp.details.Status.Code, tc.desc+" recorded")
+		u.Is(tc.err.Error(), sp.details.Status.Message, tc.desc+" message")
+		u.Like(logs.ReadAll(), tc.desc+" logged",
+			"*span finished with error", u.S(`"code":`, tc.code))
+	}
+	u.Is("", logs.ReadAll(), "no unexpected logs")
+}
+
+func TestConcurrentAttrs(t *testing.T) {
+	u, logs, _, reg := fakeSetup(t, "SPAN_MAX_ATTRIBUTES", "800")
+
+	sp := reg.NewFactory().NewSpan().(*Span)
+	u.Is(sp, sp.Concurrent(), "Concurrent() returns same Factory")
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				key := fmt.Sprintf("g%d.%d", g, i)
+				if 0 == i%2 {
+					sp.AddAttribute(key, i)
+				} else {
+					sp.AddPairs(key, "v")
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	u.Is(800, len(sp.details.Attributes.AttributeMap), "all attributes kept")
+	sp.Finish()
+	u.Is("", logs.ReadAll(), "no logs")
+}
+
+func TestFinishWith(t *testing.T) {
+	u, logs, ft, reg := fakeSetup(t)
+
+	sp := reg.NewFactory().NewSpan().SetDisplayName("handler").(*Span)
+	u.IsNot(time.Duration(0),
+		sp.FinishWith("status", 404, "bytes", 0, "cached", false, "user", "x"),
+		"FinishWith duration")
+	u.Is("", logs.ReadAll(), "FinishWith logs nothing")
+	reg.WaitForIdleRunners()
+
+	written := ft.spans()
+	if u.Is(1, len(written), "finished span written") &&
+		u.IsNot(nil, written[0].Attributes, "attributes written") {
+		attrs := written[0].Attributes.AttributeMap
+		u.Is(2, len(attrs), "zero values suppressed")
+		u.Is(404, attrs["status"].IntValue, "status attribute")
+		u.Is("x", attrs["user"].StringValue.Value, "user attribute")
+	}
+
+	u.Is(time.Duration(0), sp.FinishWith("late", 1), "FinishWith twice")
+	u.Like(logs.ReadAll(), "FinishWith twice logs", "Finish[(][)]ed",
+		"FinishWith")
+	empty := reg.NewFactory().(*Span)
+	u.Is(time.Duration(0), empty.FinishWith("k", "v"), "empty FinishWith")
+	u.Like(logs.ReadAll(), "empty FinishWith logs", "*empty")
+
+	sp = reg.NewFactory().NewSpan().(*Span)
+	sp.FinishWith("odd")
+	u.Like(logs.ReadAll(), "unpaired arg logs", "*unpaired last arg")
+	u.Is(true, sp.GetDuration() > 0, "finished despite unpaired arg")
+}
+
+func TestQueueWait(t *testing.T) {
+	u, logs, ft, reg := fakeSetup(t, "SPAN_BATCH_SIZE", "1")
+	waited := spanQueueSeconds.WithLabelValues(os.Getenv("LAGER_SPAN_PREFIX"))
+	waitSum := func() float64 {
+		var m dto.Metric
+		if err := waited.(prometheus.Metric).Write(&m); nil != err {
+			panic(err)
+		}
+		return m.GetHistogram().GetSampleSum()
+	}
+	count, sum := sampleCount(waited), waitSum()
+
+	reg.WaitForIdleRunners()
+	u.Is(count, sampleCount(waited), "control spans not observed")
+
+	// First span keeps the runner busy writing so the second one waits:
+	ft.setDelay(100 * time.Millisecond)
+	fact := reg.NewFactory()
+	fact.NewSpan().Finish()
+	time.Sleep(10 * time.Millisecond) // Let the runner start writing
+	fact.NewSpan().Finish()
+	reg.WaitForIdleRunners()
+
+	u.Is(count+2, sampleCount(waited), "each span's queue wait observed")
+	u.Is(true, 0.05 <= waitSum()-sum, "delayed span waited in queue")
+	u.Is(2, len(ft.spans()), "spans written")
+	u.Is("", logs.ReadAll(), "no logs")
+}
+
+func TestSharedFactory(t *testing.T) {
+	u, logs, _, reg := fakeSetup(t, "SPAN_QUEUE_CAPACITY", "1000")
+
+	// NewTrace() and NewSubSpan() on one span at once (run with -race):
+	shared := reg.NewFactory()
+	parent := shared.NewSpan()
+	const workers, each = 8, 50
+	ids := make(chan string, 3*workers*each)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < each; i++ {
+				sp := shared.NewSpan()
+				ids <- sp.GetTraceID()
+				sp.Finish()
+				tr := parent.NewTrace()
+				ids <- tr.GetTraceID()
+				tr.Finish()
+				kid := parent.NewSubSpan()
+				ids <- spans.HexSpanID(kid.GetSpanID())
+				kid.Finish()
+			}
+		}()
+	}
+	wg.Wait()
+	close(ids)
+	u.Is(workers*each, int(parent.(*Span).details.ChildSpanCount),
+		"child spans counted")
+	parent.Finish()
+
+	seen := make(map[string]bool)
+	for id := range ids {
+		seen[id] = true
+	}
+	u.Is(3*workers*each, len(seen), "all trace and span IDs unique")
+	u.Is(uint64(0), shared.GetSpanID(), "shared Factory still empty")
+	reg.WaitForIdleRunners()
+	u.Is("", logs.ReadAll(), "no logs")
+}
+
+func TestTraceHeaderName(t *testing.T) {
+	u, logs, _, reg := fakeSetup(t)
+	fact := reg.NewFactory()
+
+	sp := fact.NewSpan()
+	head := make(http.Header)
+	u.Is(sp, sp.SetHeader(head), "SetHeader returns same Factory")
+	u.Is(sp.GetCloudContext()+";o=1", head.Get(spans.TraceHeader),
+		"default header")
+
+	reg.SetTraceHeader("X-Internal-Trace")
+	head = make(http.Header)
+	sp.SetHeader(head)
+	u.Is(sp.GetCloudContext()+";o=1", head.Get("X-Internal-Trace"),
+		"inject under custom header")
+	u.Is("", head.Get(spans.TraceHeader), "standard header not set")
+
+	im := fact.ImportFromHeaders(head)
+	u.Is(sp.GetTraceID(), im.GetTraceID(), "import trace from custom header")
+	u.Is(sp.GetSpanID(), im.GetSpanID(), "import span from custom header")
+	std := http.Header{spans.TraceHeader: {sp.GetCloudContext()}}
+	u.Is(uint64(0), fact.ImportFromHeaders(std).GetSpanID(),
+		"standard header ignored when custom configured")
+
+	reg.SetTraceHeader("")
+	defer func(orig string) { TraceHeader = orig }(TraceHeader)
+	TraceHeader = "X-Proxy-Trace"
+	head = make(http.Header)
+	sp.SetHeader(head)
+	u.Is(sp.GetCloudContext()+";o=1", head.Get("X-Proxy-Trace"),
+		"inject under package default")
+	u.Is(sp.GetSpanID(), fact.ImportFromHeaders(head).GetSpanID(),
+		"import under package default")
+
+	// Changing the header name while propagating (run with -race):
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			reg.SetTraceHeader("X-Internal-Trace")
+			reg.SetTraceHeader("")
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		head = make(http.Header)
+		sp.SetHeader(head)
+		fact.ImportFromHeaders(head)
+	}
+	wg.Wait()
+	sp.Finish()
+	u.Is("", logs.ReadAll(), "no logs")
+}
+
+func TestBatchBytes(t *testing.T) {
+	u, logs, ft, reg := fakeSetup(t, "SPAN_BATCH_BYTES", "4000")
+	bySize := spanCreateSeconds.WithLabelValues("fake-proj", "bytes", "ok")
+	count := sampleCount(bySize)
+
+	big := strings.Repeat("x", 1500)
+	fact := reg.NewFactory()
+	for i := 0; i < 5; i++ {
+		sp := fact.NewSpan()
+		sp.AddAttribute("payload", big)
+		sp.Finish()
+	}
+	reg.WaitForIdleRunners()
+
+	ft.mu.Lock()
+	batches := ft.batches
+	ft.mu.Unlock()
+	written := 0
+	for i, batch := range batches {
+		size := 0
+		for _, sp := range batch {
+			size += spanSize(sp)
+		}
+		u.Is(true, size <= 4000, fmt.Sprintf("batch %d size %d", i, size))
+		written += len(batch)
+	}
+	u.Is(5, written, "all spans written")
+	u.Is(3, len(batches), "batches split by size")
+	u.Is(count+2, sampleCount(bySize), "bytes trigger recorded")
+
+	huge := fact.NewSpan()
+	huge.AddAttribute("payload", strings.Repeat("y", 5000))
+	huge.Finish()
+	reg.WaitForIdleRunners()
+	u.Is(6, len(ft.spans()), "span bigger than limit still written")
+	u.Is("", logs.ReadAll(), "no logs")
+
+	// A span carried over to the next batch counts toward SPAN_BATCH_SIZE:
+	ft2 := newFakeTrace()
+	reg2, _ := fakeRegistrar(t, ft2,
+		"SPAN_BATCH_BYTES", "4000", "SPAN_BATCH_SIZE", "2")
+	fact = reg2.NewFactory()
+	for _, n := range []int{1500, 3000, 10, 10, 10} {
+		sp := fact.NewSpan()
+		sp.AddAttribute("payload", strings.Repeat("z", n))
+		sp.Finish()
+	}
+	reg2.WaitForIdleRunners()
+	ft2.mu.Lock()
+	batches = ft2.batches
+	ft2.mu.Unlock()
+	sizes := make([]int, len(batches))
+	for i, batch := range batches {
+		sizes[i] = len(batch)
+	}
+	u.Is([]int{1, 2, 2}, sizes, "carried span counted toward batch size")
+	u.Is("", logs.ReadAll(), "no logs for carry")
+}
+
+func TestSpanSize(t *testing.T) {
+	u := tutl.New(t)
+
+	for _, str := range []string{
+		"", "plain", `"quoted\"`, "\x01ctl\n\t\r", "<a&b>",
+		"caf\u00e9 \u65e5\u672c", "line\u2028para\u2029", "bad\xffutf8",
+	} {
+		b, _ := json.Marshal(str)
+		u.Is(len(b), jsonStringSize(str), fmt.Sprintf("size of %q", str))
+	}
+
+	for i, sp := range []*ct2.Span{
+		{},
+		{Name: "projects/p/traces/t/spans/s", SpanId: "0123456789abcdef",
+			DisplayName: &ct2.TruncatableString{Value: "<name>"},
+			StartTime:   "2022-06-01T12:00:00Z", EndTime: "2022-06-01T12:00:01Z",
+			SpanKind: "SERVER", ChildSpanCount: 12,
+			SameProcessAsParentSpan: true, ParentSpanId: "fedcba9876543210",
+			Attributes: &ct2.Attributes{
+				AttributeMap: map[string]ct2.AttributeValue{
+					"s": {StringValue: &ct2.TruncatableString{
+						Value: "caf\u00e9\n", TruncatedByteCount: 3}},
+					"i": {IntValue: -1 << 62},
+					"b": {BoolValue: true},
+				},
+				DroppedAttributesCount: 2,
+			},
+			Status: &ct2.Status{Code: 13, Message: `"boom"`},
+		},
+		{SpanId: "1", TimeEvents: &ct2.TimeEvents{TimeEvent: []*ct2.TimeEvent{
+			{Time: "2022-06-01T12:00:00Z"}}}},
+	} {
+		b, _ := json.Marshal(sp)
+		size := spanSize(sp)
+		u.Is(true, len(b)+1 <= size,
+			fmt.Sprintf("span %d estimate %d covers %d", i, size, len(b)+1))
+		u.Is(true, size <= len(b)+1+400,
+			fmt.Sprintf("span %d estimate %d near %d", i, size, len(b)+1))
+	}
+}
+
+func TestHTTPSpans(t *testing.T) {
+	u, logs, _, reg := fakeSetup(t)
+	fact := reg.NewFactory()
+
+	sp := fact.NewSpan().(*Span)
+	u.Is(sp, sp.SetHTTPClient("GET", "https://example.com/x", 200),
+		"SetHTTPClient returns same Factory")
+	u.Is("CLIENT", sp.details.SpanKind, "client kind")
+	attrs := sp.details.Attributes.AttributeMap
+	u.Is(3, len(attrs), "client attribute count")
+	u.Is("GET", attrs[AttrHTTPMethod].StringValue.Value, "client method")
+	u.Is("https://example.com/x", attrs[AttrHTTPURL].StringValue.Value,
+		"client URL")
+	u.Is(200, attrs[AttrHTTPStatusCode].IntValue, "client status attribute")
+	u.Is(nil, sp.details.Status, "200 sets no status code")
+	sp.Finish()
+
+	sp = fact.NewSpan().(*Span)
+	sp.SetHTTPServer("POST", "/users/{id}", 500)
+	u.Is("SERVER", sp.details.SpanKind, "server kind")
+	attrs = sp.details.Attributes.AttributeMap
+	u.Is(3, len(attrs), "server attribute count")
+	u.Is("POST", attrs[AttrHTTPMethod].StringValue.Value, "server method")
+	u.Is("/users/{id}", attrs[AttrHTTPRoute].StringValue.Value,
+		"server route")
+	u.Is(500, attrs[AttrHTTPStatusCode].IntValue, "server status attribute")
+	if u.IsNot(nil, sp.details.Status, "500 sets status") {
+		u.Is(13, sp.details.Status.Code, "500 -> INTERNAL")
+	}
+	sp.Finish()
+
+	sp = fact.NewSpan().(*Span)
+	sp.SetHTTPServer("GET", "", 0)
+	u.Is(1, len(sp.details.Attributes.AttributeMap), "empty values skipped")
+	u.Is(nil, sp.details.Status, "0 status sets no status code")
+	sp.Finish()
+
+	sp.SetHTTPClient("GET", "/", 200)
+	u.Like(logs.ReadAll(), "finished span logs", "Finish[(][)]ed")
+	u.Is("", logs.ReadAll(), "no other logs")
+}
+
+func TestWriteHealth(t *testing.T) {
+	u, logs, ft, reg := fakeSetup(t)
+	fact := reg.NewFactory()
+	write := func() {
+		fact.NewSpan().Finish()
+		reg.WaitForIdleRunners()
+	}
+	window := 100 * time.Millisecond
+
+	when, err := reg.LastWriteError()
+	u.Is(true, when.IsZero(), "no failure time yet")
+	u.Is(nil, err, "no failure yet")
+	u.Is(true, reg.Healthy(window), "healthy when idle")
+
+	write()
+	u.Is(true, reg.Healthy(window), "healthy after success")
+
+	// Being idle for longer than 'window' is not counted as failing:
+	time.Sleep(window + 10*time.Millisecond)
+	ft.setStatus(http.StatusForbidden)
+	write()
+	u.Like(logs.ReadAll(), "failure logged", "*failed to create span batch")
+	when, err = reg.LastWriteError()
+	u.IsNot(nil, err, "failure recorded")
+	u.Is(true, time.Since(when) < time.Second, "failure time recent")
+	u.Is(true, reg.Healthy(window), "brief failure streak still healthy")
+
+	time.Sleep(window + 10*time.Millisecond)
+	write()
+	logs.ReadAll()
+	u.Is(false, reg.Healthy(window), "failure streak longer than window")
+	u.Is(true, reg.Healthy(time.Minute), "streak shorter than larger window")
+
+	ft.setStatus(http.StatusOK)
+	write()
+	u.Is(true, reg.Healthy(window), "healthy after recovery")
+	_, err = reg.LastWriteError()
+	u.IsNot(nil, err, "last error kept after recovery")
+	u.Is("", logs.ReadAll(), "no more logs")
+
+	var zero Registrar
+	u.Is(true, zero.Healthy(window), "zero Registrar healthy")
+	when, err = zero.LastWriteError()
+	u.Is(true, when.IsZero(), "zero Registrar has no failure time")
+	u.Is(nil, err, "zero Registrar has no failure")
+}
+
+func TestImportFromPath(t *testing.T) {
+	u, logs, _, reg := fakeSetup(t)
+	fact := reg.NewFactory()
+	sp := fact.NewSpan()
+	traceID, hexID := sp.GetTraceID(), spans.HexSpanID(sp.GetSpanID())
+
+	im, err := fact.(*Span).ImportFromPath(
+		"projects/other-proj/traces/" + traceID + "/spans/" + hexID)
+	u.Is(nil, err, "full path")
+	if u.IsNot(nil, im, "full path Factory") {
+		u.Is(traceID, im.GetTraceID(), "full path trace ID")
+		u.Is(sp.GetSpanID(), im.GetSpanID(), "full path span ID")
+		u.Is("fake-proj", im.GetProjectID(), "project from Factory")
+	}
+
+	im, err = fact.(*Span).ImportFromPath(traceID + "/" + hexID)
+	u.Is(nil, err, "short path")
+	if u.IsNot(nil, im, "short path Factory") {
+		u.Is(sp.GetSpanID(), im.GetSpanID(), "short path span ID")
+	}
+	im, err = fact.(*Span).ImportFromPath(traceID + "/1f")
+	u.Is(nil, err, "short hex span ID")
+	if u.IsNot(nil, im, "short hex span ID Factory") {
+		u.Is(uint64(0x1f), im.GetSpanID(), "short hex span ID value")
+	}
+
+	for _, tc := range []struct{ path, desc string }{
+		{"", "has 1 parts"},
+		{traceID, "has 1 parts"},
+		{"a/b/c", "has 3 parts"},
+		{"proj/p/traces/" + traceID + "/spans/" + hexID, "not like"},
+		{"projects//traces/" + traceID + "/spans/" + hexID, "empty project"},
+		{traceID + "/", "invalid span id"},
+		{traceID + "/xyz", "not hex"},
+		{traceID + "/00000000000000001", "length 17"},
+		{traceID + "/0", "span id of 0"},
+		{"abc/" + hexID, "invalid trace id"},
+		{strings.Repeat("g", 32) + "/" + hexID, "non-hex char"},
+	} {
+		im, err = fact.(*Span).ImportFromPath(tc.path)
+		u.Is(true, nil == im, "no Factory for "+tc.path)
+		u.Like(err, "error for "+tc.path, "*"+tc.desc)
+	}
+	sp.Finish()
+	u.Is("", logs.ReadAll(), "no logs")
+}
+
+func TestAttributeLimit(t *testing.T) {
+	u, logs, ft, reg := fakeSetup(t)
+
+	sp := reg.NewFactory().NewSpan().SetDisplayName("leaky").(*Span)
+	for i := 0; i < MaxAttributes+50; i++ {
+		u.Is(nil, sp.AddAttribute(fmt.Sprintf("k%d", i), i), "add attr")
+	}
+	log := string(logs.ReadAll())
+	u.Is(1, strings.Count(log, "Too many attributes"), "warned once")
+	u.Like(log, "drop warning", "leaky", u.S("k", MaxAttributes, `"`))
+
+	u.Is(nil, sp.AddAttribute("k0", "replaced"), "replace existing attr")
+	u.Is("", logs.ReadAll(), "replacing does not warn")
+
+	sp.Finish()
+	reg.WaitForIdleRunners()
+	written := ft.spans()
+	if u.Is(1, len(written), "span written") {
+		attrs := written[0].Attributes
+		u.Is(MaxAttributes, len(attrs.AttributeMap), "attributes kept")
+		u.Is(50, attrs.DroppedAttributesCount, "attributes dropped")
+		u.Is("replaced", attrs.AttributeMap["k0"].StringValue.Value,
+			"existing key still updated")
+	}
+
+	other := reg.NewFactory().NewSpan().(*Span)
+	for i := 0; i < MaxAttributes+1; i++ {
+		other.AddAttribute(fmt.Sprintf("k%d", i), i)
+	}
+	u.Is(1, strings.Count(string(logs.ReadAll()), "Too many attributes"),
+		"each span warns once")
+
+	small, _ := fakeRegistrar(t, newFakeTrace(), "SPAN_MAX_ATTRIBUTES", "2")
+	sp = small.NewFactory().NewSpan().(*Span)
+	for i := 0; i < 3; i++ {
+		sp.AddAttribute(fmt.Sprintf("k%d", i), i)
+	}
+	u.Is(2, len(sp.details.Attributes.AttributeMap), "SPAN_MAX_ATTRIBUTES")
+	u.Like(logs.ReadAll(), "env limit logged", `"limit":2`)
+
+	t.Setenv("SPAN_MAX_ATTRIBUTES", "0")
+	_, err := NewRegistrar("fake-proj", ft.client())
+	u.Like(err, "invalid limit", "SPAN_MAX_ATTRIBUTES", "at least 1")
+}
+
+func TestOnSpanDropped(t *testing.T) {
+	u := tutl.New(t)
+	logs := new(buffer.AsyncBuffer)
+	defer lager.SetOutput(logs)()
+
+	var mu sync.Mutex
+	var got []string
+	hook := func(sp Span, reason string) {
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, sp.details.DisplayName.Value+":"+reason)
+	}
+	dropped := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		was := got
+		got = nil
+		return was
+	}
+
+	ft := newFakeTrace()
+	reg, _ := fakeRegistrar(t, ft,
+		"SPAN_QUEUE_CAPACITY", "1", "SPAN_BATCH_SIZE", "1")
+	reg.OnSpanDropped(hook)
+	fact := reg.NewFactory()
+
+	ft.setDelay(300 * time.Millisecond)
+	fact.NewSpan().SetDisplayName("writing").Finish()
+	time.Sleep(30 * time.Millisecond) // Let the runner start writing it
+	fact.NewSpan().SetDisplayName("queued").Finish()
+	fact.NewSpan().SetDisplayName("overflow").Finish()
+	u.Is([]string{"overflow:queue_full"}, dropped(), "queue full")
+	reg.WaitForIdleRunners()
+	u.Is(0, len(dropped()), "written spans not reported")
+
+	ft.setDelay(0)
+	ft.setStatus(http.StatusForbidden)
+	fact.NewSpan().SetDisplayName("rejected").Finish()
+	reg.WaitForIdleRunners()
+	u.Is([]string{"rejected:write_failed"}, dropped(), "write failure")
+	u.Like(logs.ReadAll(), "failure logged", "*failed to create span batch")
+
+	// A span keeps the hook that was set when a runner read it:
+	ft.setDelay(100 * time.Millisecond)
+	fact.NewSpan().SetDisplayName("read").Finish()
+	time.Sleep(30 * time.Millisecond) // Let the runner start writing it
+	reg.OnSpanDropped(nil)
+	reg.WaitForIdleRunners()
+	u.Is([]string{"read:write_failed"}, dropped(), "hook kept once read")
+	logs.ReadAll()
+	ft.setDelay(0)
+	ft.setStatus(http.StatusOK)
+
+	// Changing the hook while spans are Finish()ed (run with -race):
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			reg.OnSpanDropped(hook)
+			reg.OnSpanDropped(nil)
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		fact.NewSpan().SetDisplayName("busy").Finish()
+	}
+	wg.Wait()
+	reg.WaitForIdleRunners()
+	for _, d := range dropped() {
+		u.Is("busy:queue_full", d, "only full queue drops while changing hook")
+	}
+
+	ft.setStatus(http.StatusForbidden)
+	fact.NewSpan().SetDisplayName("unhooked").Finish()
+	reg.WaitForIdleRunners()
+	u.Is(0, len(dropped()), "hook removed")
+	logs.ReadAll()
+	ft.setStatus(http.StatusOK)
+
+	unsampled, _ := fakeRegistrar(t, newFakeTrace(), "SPAN_SAMPLE_RATE", "0")
+	unsampled.OnSpanDropped(hook)
+	unsampled.NewFactory().NewTrace().SetDisplayName("skipped").Finish()
+	u.Is([]string{"skipped:unsampled"}, dropped(), "unsampled")
+	u.Is("", logs.ReadAll(), "no other logs")
+}
+
+func TestMetadata(t *testing.T) {
+	u, logs, _, reg := fakeSetup(t)
+	fact := reg.NewFactory().(*Span)
+
+	sp := fact.NewTrace().(*Span)
+	md := metadata.MD{}
+	u.Is(sp, sp.InjectIntoMetadata(md), "Inject returns same Factory")
+	u.Is([]string{sp.GetCloudContext() + ";o=1"}, md["x-cloud-trace-context"],
+		"inject under lowercased key")
+
+	im := fact.ImportFromMetadata(md)
+	u.Is(sp.GetTraceID(), im.GetTraceID(), "round-trip trace ID")
+	u.Is(sp.GetSpanID(), im.GetSpanID(), "round-trip span ID")
+	head := make(http.Header)
+	sp.SetHeader(head)
+	u.Is(fact.ImportFromHeaders(head).GetCloudContext(), im.GetCloudContext(),
+		"same as HTTP import")
+	u.Is(true, im.NewSpan().(*Span).IsSampled(), "round-trip o=1")
+
+	// The "o=0" decision survives a round trip through metadata:
+	unsampled := metadata.Pairs("x-cloud-trace-context",
+		sp.GetCloudContext()+";o=0")
+	kid := fact.ImportFromMetadata(unsampled).NewSpan().(*Span)
+	u.Is(false, kid.IsSampled(), "import o=0 from metadata")
+	md = metadata.MD{}
+	kid.InjectIntoMetadata(md)
+	u.Like(md.Get("x-cloud-trace-context")[0], "inject o=0", ";o=0$")
+	u.Is(false, fact.ImportFromMetadata(md).NewSpan().(*Span).IsSampled(),
+		"round-trip o=0")
+
+	pairs := metadata.Pairs("X-Cloud-Trace-Context", sp.GetCloudContext())
+	u.Is(sp.GetSpanID(), fact.ImportFromMetadata(pairs).GetSpanID(),
+		"import from metadata.Pairs()")
+	u.Is(uint64(0), fact.ImportFromMetadata(metadata.MD{}).GetSpanID(),
+		"missing key gives empty Factory")
+	bad := metadata.Pairs("x-cloud-trace-context", "junk")
+	u.Is(uint64(0), fact.ImportFromMetadata(bad).GetSpanID(),
+		"invalid context gives empty Factory")
+
+	empty := metadata.MD{}
+	reg.NewFactory().(*Span).InjectIntoMetadata(empty)
+	u.Is(0, len(empty), "empty Factory injects nothing")
+
+	reg.SetTraceHeader("X-Internal-Trace")
+	md = metadata.MD{}
+	sp.InjectIntoMetadata(md)
+	u.Is([]string{sp.GetCloudContext() + ";o=1"}, md["x-internal-trace"],
+		"inject under custom header")
+	u.Is(sp.GetSpanID(), fact.ImportFromMetadata(md).GetSpanID(),
+		"import from custom header")
+	reg.SetTraceHeader("")
+
+	sp.Finish()
+	u.Is("", logs.ReadAll(), "no logs")
+}
+
+func TestSpanTimePrecision(t *testing.T) {
+	u := tutl.New(t)
+
+	start := time.Date(2022, 7, 4, 12, 30, 15, 123456000, time.UTC)
+	end := start.Add(250 * time.Nanosecond)
+	u.Is(TimeAsString(start), TimeAsString(end), "micros collapse")
+	u.Is("2022-07-04T12:30:15.123456Z", spanTime(start), "trailing 0s trimmed")
+	u.Is("2022-07-04T12:30:15.12345625Z", spanTime(end), "nanos kept")
+	u.Is("2022-07-04T12:30:15Z", spanTime(start.Truncate(time.Second)),
+		"no fraction")
+	for _, when := range []time.Time{start, end} {
+		parsed, err := time.Parse(time.RFC3339Nano, spanTime(when))
+		u.Is(nil, err, "parse as RFC3339")
+		u.Is(true, when.Equal(parsed), "round-trip "+spanTime(when))
+	}
+	local := end.In(time.FixedZone("PDT", -7*60*60))
+	u.Is(spanTime(end), spanTime(local), "always Zulu")
+
+	defer func(orig string) { SpanTimeLayout = orig }(SpanTimeLayout)
+	SpanTimeLayout = ZuluTime
+	u.Is(TimeAsString(end), spanTime(end), "microsecond layout")
+
+	ft := newFakeTrace()
+	reg, _ := fakeRegistrar(t, ft)
+	SpanTimeLayout = ZuluTimeNano
+	sp := reg.NewFactory().NewSpan().(*Span)
+	sp.SetStartTime(start)
+	sp.FinishAt(end)
+	reg.WaitForIdleRunners()
+	written := ft.spans()
+	if u.Is(1, len(written), "span written") {
+		u.Is(spanTime(start), written[0].StartTime, "written start")
+		u.Is(spanTime(end), written[0].EndTime, "written nano end")
+	}
+}
+
+// fakeTimer is a batch timer made by a fakeClock.  It only fires when the
+// test calls fire().
+type fakeTimer struct {
+	dur     time.Duration
+	c       chan time.Time
+	mu      sync.Mutex
+	stopped bool
+	fired   bool
+}
+
+// stop() is the fakeTimer's replacement for time.Timer.Stop().
+func (tm *fakeTimer) stop() bool {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	active := !tm.stopped && !tm.fired
+	tm.stopped = true
+	return active
+}
+
+// isStopped() returns whether the runner stopped the timer.
+func (tm *fakeTimer) isStopped() bool {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	return tm.stopped
+}
+
+// fire() delivers the timeout and returns 'true' once the runner has
+// received it.  Returns 'false' if the runner doesn't receive it within a
+// second (so a broken test fails rather than hangs).
+func (tm *fakeTimer) fire() bool {
+	tm.mu.Lock()
+	tm.fired = true
+	tm.mu.Unlock()
+	select {
+	case tm.c <- time.Now():
+		return true
+	case <-time.After(time.Second):
+		return false
+	}
+}
+
+// fakeClock replaces newTimer so that tests decide when batch timeouts
+// happen.  Each timer made is sent to 'made'.  If 'hold' is not nil, then a
+// runner making a timer waits until release() is called.
+type fakeClock struct {
+	made chan *fakeTimer
+	hold chan struct{}
+	once sync.Once
+}
+
+// useFakeClock() replaces newTimer until the test ends.  Call it before
+// fakeSetup() so that the runners are halted before newTimer is restored.
+// If 'hold' is true, then call release() (deferred) before Halt().
+//
+func useFakeClock(t *testing.T, hold bool) *fakeClock {
+	fc := &fakeClock{made: make(chan *fakeTimer, 100)}
+	if hold {
+		fc.hold = make(chan struct{})
+	}
+	orig := newTimer
+	t.Cleanup(func() { newTimer = orig })
+	newTimer = func(d time.Duration) (<-chan time.Time, func() bool) {
+		tm := &fakeTimer{dur: d, c: make(chan time.Time)}
+		fc.made <- tm
+		if nil != fc.hold {
+			<-fc.hold
+		}
+		return tm.c, tm.stop
+	}
+	return fc
+}
+
+// next() returns the next timer made, or nil if no more have been made.
+func (fc *fakeClock) next() *fakeTimer {
+	select {
+	case tm := <-fc.made:
+		return tm
+	default:
+		return nil
+	}
+}
+
+// release() lets any held runners continue.
+func (fc *fakeClock) release() {
+	fc.once.Do(func() { close(fc.hold) })
+}
+
+func TestBatchTimerLifecycle(t *testing.T) {
+	clock := useFakeClock(t, false)
+	u, logs, ft, reg := fakeSetup(t)
+	fact := reg.NewFactory()
+	batches := func() int {
+		ft.mu.Lock()
+		defer ft.mu.Unlock()
+		return len(ft.batches)
+	}
+	jittered := func(tm *fakeTimer) bool {
+		return time.Second <= tm.dur && tm.dur < 1500*time.Millisecond
+	}
+
+	// The first span of a batch starts a timer that writes the batch:
+	fact.NewSpan().Finish()
+	reg.WaitForRunnerRead()
+	tm := clock.next()
+	if !u.Is(true, nil != tm, "timer started for first span") {
+		return
+	}
+	u.Is(true, jittered(tm), u.S("timer duration ", tm.dur))
+	fact.NewSpan().Finish()
+	reg.WaitForRunnerRead()
+	u.Is(true, nil == clock.next(), "no timer for second span")
+	u.Is(0, batches(), "nothing written before timeout")
+	u.Is(true, tm.fire(), "runner got timeout")
+	reg.WaitForRunnerRead()
+	u.Is(1, batches(), "timeout wrote batch")
+	u.Is(2, len(ft.spans()), "both spans written")
+	u.Is(false, tm.isStopped(), "fired timer not stopped")
+	u.Is(true, nil == clock.next(), "no timer while batch is empty")
+
+	// A flush stops the timer and the next batch gets a new one:
+	fact.NewSpan().Finish()
+	reg.WaitForRunnerRead()
+	stale := clock.next()
+	if !u.Is(true, nil != stale, "timer started for next batch") {
+		return
+	}
+	reg.WaitForIdleRunners()
+	u.Is(2, batches(), "flush wrote batch")
+	u.Is(true, stale.isStopped(), "flush stopped timer")
+	u.Is(true, nil == clock.next(), "no timer after flush")
+
+	fact.NewSpan().Finish()
+	reg.WaitForRunnerRead()
+	tm = clock.next()
+	if !u.Is(true, nil != tm && stale != tm, "new timer after flush") {
+		return
+	}
+	select {
+	case stale.c <- time.Now():
+		u.Is(true, false, "runner received stale timeout")
+	default:
+	}
+	reg.WaitForRunnerRead()
+	u.Is(2, batches(), "stale timer did not flush")
+	u.Is(true, tm.fire(), "runner got new timeout")
+	reg.WaitForRunnerRead()
+	u.Is(3, batches(), "new timer wrote batch")
+	u.Is(4, len(ft.spans()), "each span written once")
+
+	// Halt() writes the partial batch and stops its timer:
+	fact.NewSpan().Finish()
+	reg.WaitForRunnerRead()
+	tm = clock.next()
+	reg.Halt()
+	u.Is(4, batches(), "partial batch written by Halt()")
+	u.Is(5, len(ft.spans()), "last span written")
+	if u.Is(true, nil != tm, "timer started before halt") {
+		u.Is(true, tm.isStopped(), "Halt() stopped timer")
+	}
+	u.Is(true, nil == clock.next(), "no extra timers")
+	u.Is("", logs.ReadAll(), "no logs")
+}
+
+// sourceHelper() creates a span the way a helper would, recording the
+// location of its caller.
+func sourceHelper(fact spans.Factory) *Span {
+	return fact.NewSpan().(*Span).SetSource(1).(*Span)
+}
+
+func TestSetSource(t *testing.T) {
+	u, logs, _, reg := fakeSetup(t)
+	fact := reg.NewFactory()
+
+	_, file, line, _ := runtime.Caller(0)
+	sp := fact.NewSpan().(*Span)
+	u.Is(sp, sp.SetSource(0), "SetSource returns same Factory")
+	attrs := sp.details.Attributes.AttributeMap
+	u.Is(file, attrs[AttrCodeFilepath].StringValue.Value, "skip 0 file")
+	u.Is(line+2, attrs[AttrCodeLineno].IntValue, "skip 0 line")
+	u.Like(attrs[AttrCodeFunction].StringValue.Value, "skip 0 function",
+		"^github.com/.*/trace[.]TestSetSource$")
+
+	_, _, line, _ = runtime.Caller(0)
+	kid := sourceHelper(sp)
+	attrs = kid.details.Attributes.AttributeMap
+	u.Is(file, attrs[AttrCodeFilepath].StringValue.Value, "skip 1 file")
+	u.Is(line+1, attrs[AttrCodeLineno].IntValue, "skip 1 line")
+	u.Like(attrs[AttrCodeFunction].StringValue.Value, "skip 1 function",
+		"[.]TestSetSource$")
+	kid.Finish()
+	sp.Finish()
+	u.Is("", logs.ReadAll(), "no logs")
+
+	empty := reg.NewFactory().(*Span)
+	u.Is(empty, empty.SetSource(0), "empty returns same Factory")
+	u.Is("", logs.ReadAll(), "empty is a silent no-op")
+	sp.SetSource(0)
+	u.Like(logs.ReadAll(), "finished span logs", "Finish[(][)]ed")
+}
+
+func TestMetricPrefix(t *testing.T) {
+	u := tutl.New(t)
+	logs := new(buffer.AsyncBuffer)
+	defer lager.SetOutput(logs)()
+
+	t.Setenv("LAGER_SPAN_PREFIX", "from-env")
+	ftEnv, ftA, ftB := newFakeTrace(), newFakeTrace(), newFakeTrace()
+	fromEnv, _ := fakeRegistrar(t, ftEnv)
+	u.Is("from-env", fromEnv.domain, "prefix defaults to env var")
+
+	regA, err := NewRegistrar("fake-proj", ftA.client(),
+		WithMetricPrefix("sampled"))
+	u.Is(nil, err, "first Registrar with prefix")
+	defer regA.Halt()
+	defer ftA.srv.Close()
+	regB, err := NewRegistrar("fake-proj", ftB.client(),
+		WithMetricPrefix("full"))
+	u.Is(nil, err, "second Registrar with prefix")
+	defer regB.Halt()
+	defer ftB.srv.Close()
+	u.Is("sampled", regA.domain, "first prefix")
+	u.Is("full", regB.domain, "second prefix")
+
+	waitA := spanQueueSeconds.WithLabelValues("sampled")
+	waitB := spanQueueSeconds.WithLabelValues("full")
+	wasA, wasB := sampleCount(waitA), sampleCount(waitB)
+	regA.NewFactory().NewSpan().Finish()
+	regA.WaitForIdleRunners()
+	u.Is(wasA+1, sampleCount(waitA), "queue wait under first prefix")
+	u.Is(wasB, sampleCount(waitB), "not under second prefix")
+
+	dropB := spansDropped.WithLabelValues("full")
+	dropEnv := spansDropped.WithLabelValues("from-env")
+	wasDropB, wasDropEnv := counterValue(dropB), counterValue(dropEnv)
+	full := regB.NewFactory().NewSpan().(*Span)
+	full.ch = make(chan Span) // Nobody reading, so always full
+	full.Finish()
+	u.Is(wasDropB+1, counterValue(dropB), "drop under second prefix")
+	u.Is(wasDropEnv, counterValue(dropEnv), "not under env prefix")
+	u.Is("", logs.ReadAll(), "no logs")
+
+	invalidA := spansInvalid.WithLabelValues("sampled", "end_before_start")
+	invalidB := spansInvalid.WithLabelValues("full", "end_before_start")
+	wasInvalidA, wasInvalidB := counterValue(invalidA), counterValue(invalidB)
+	bad := regA.NewFactory().NewSpan().SetDisplayName("backwards")
+	bad.(*Span).details.StartTime = TimeAsString(time.Now().Add(time.Hour))
+	bad.Finish()
+	regA.WaitForIdleRunners()
+	u.Is(wasInvalidA+1, counterValue(invalidA), "invalid under first prefix")
+	u.Is(wasInvalidB, counterValue(invalidB), "not under second prefix")
+	u.Like(logs.ReadAll(), "invalid span logged with prefix",
+		"*dropped invalid span", `"domain":"sampled"`)
+}
+
+func TestContextTraceFields(t *testing.T) {
+	u, logs, _, reg := fakeSetup(t)
+
+	check := func(ctx context.Context, desc string) {
+		traceID, spanID, ok := ContextTraceFields(ctx)
+		u.Is(false, ok, desc+" not ok")
+		u.Is("", traceID, desc+" no trace ID")
+		u.Is("", spanID, desc+" no span ID")
+	}
+	check(nil, "nil")
+	check(context.Background(), "undecorated")
+	empty := spans.ContextStoreSpan(context.Background(), reg.NewFactory())
+	check(empty, "empty Factory")
+
+	outer := reg.NewFactory().NewTrace()
+	ctx := spans.ContextStoreSpan(context.Background(), outer)
+	traceID, spanID, ok := ContextTraceFields(ctx)
+	u.Is(true, ok, "decorated ok")
+	u.Is(outer.GetTraceID(), traceID, "decorated trace ID")
+	u.Is(spans.HexSpanID(outer.GetSpanID()), spanID, "decorated span ID")
+
+	inner := PushSpan(nil, &ctx, "inner")
+	traceID, spanID, ok = ContextTraceFields(ctx)
+	u.Is(true, ok, "nested ok")
+	u.Is(outer.GetTraceID(), traceID, "nested trace ID")
+	u.Is(spans.HexSpanID(inner.GetSpanID()), spanID, "innermost span ID")
+	u.IsNot(spans.HexSpanID(outer.GetSpanID()), spanID, "not outer span")
+	inner.Finish()
+	outer.Finish()
+	u.Is("", logs.ReadAll(), "no logs")
+}
+
+func TestDisplayNameTruncation(t *testing.T) {
+	u, logs, _, reg := fakeSetup(t)
+	fact := reg.NewFactory()
+
+	short := fact.NewSpan().SetDisplayName("short").(*Span)
+	u.Is("short", short.details.DisplayName.Value, "short name intact")
+	u.Is(0, short.details.DisplayName.TruncatedByteCount, "short not cut")
+	u.Is("", logs.ReadAll(), "short name logs nothing")
+
+	long := strings.Repeat("x", MaxDisplayNameBytes-1) + "é" + "tail"
+	sp := fact.NewSpan().SetDisplayName(long).(*Span)
+	name := sp.details.DisplayName
+	u.Is(strings.Repeat("x", MaxDisplayNameBytes-1), name.Value,
+		"truncated without splitting a character")
+	u.Is(len(long)-MaxDisplayNameBytes+1, name.TruncatedByteCount,
+		"truncated byte count")
+	u.Like(logs.ReadAll(), "truncation logged", "WARN",
+		"display name too long", `"bytes":133`)
+	sp.SetDisplayName(long + "more")
+	u.Is(len(long)+4-MaxDisplayNameBytes+1, name.TruncatedByteCount,
+		"truncated again")
+	u.Is("", logs.ReadAll(), "only first truncation per span logged")
+	sp.SetDisplayName("fine")
+	u.Is(0, name.TruncatedByteCount, "count cleared for short name")
+
+	url := "/users/123?token=" + strings.Repeat("a", 200)
+	kept := fact.NewSpan().SetDisplayName(url).(*Span).details.DisplayName
+	u.Is(MaxDisplayNameBytes, len(kept.Value), "query kept by default")
+	logs.ReadAll()
+
+	defer func() { StripDisplayNameQuery = false }()
+	StripDisplayNameQuery = true
+	stripped := fact.NewSpan().SetDisplayName(url).(*Span).details.DisplayName
+	u.Is("/users/123", stripped.Value, "query stripped")
+	u.Is(0, stripped.TruncatedByteCount, "stripping is not truncation")
+	u.Is(true, nil == fact.NewSpan().SetDisplayName("?x").(*Span).
+		details.DisplayName, "name of only a query is cleared")
+	u.Is("", logs.ReadAll(), "stripping logs nothing")
+}
+
+func TestAddAttributes(t *testing.T) {
+	u, logs, _, reg := fakeSetup(t)
+
+	sp := reg.NewFactory().NewSpan().(*Span)
+	u.Is(sp, sp.AddAttributes(map[string]interface{}{
+		"user":    "ann",
+		"count":   12,
+		"big":     int64(1) << 40,
+		"cached":  true,
+		"err":     errors.New("oops"),
+		"skipped": 0,
+		"off":     false,
+		"none":    nil,
+		"ratio":   0.5,
+	}), "AddAttributes returns same Factory")
+	u.Like(logs.ReadAll(), "unsupported type logged",
+		"Error adding attribute", `"key":"ratio"`, "Invalid value type",
+		"float64", `"_file":"module/trace/tr_test.go"`)
+	attrs := sp.details.Attributes.AttributeMap
+	u.Is(5, len(attrs), "zero values and unsupported type skipped")
+	u.Is("ann", attrs["user"].StringValue.Value, "string attribute")
+	u.Is(12, attrs["count"].IntValue, "int attribute")
+	u.Is(int64(1)<<40, attrs["big"].IntValue, "int64 attribute")
+	u.Is(true, attrs["cached"].BoolValue, "bool attribute")
+	u.Is("oops", attrs["err"].StringValue.Value, "error attribute")
+	sp.AddAttributes(nil)
+	u.Is("", logs.ReadAll(), "nil map is fine")
+	sp.Finish()
+
+	empty := reg.NewFactory().(*Span)
+	u.Is(empty, empty.AddAttributes(map[string]interface{}{"a": 1, "b": 2}),
+		"empty returns same Factory")
+	log := string(logs.ReadAll())
+	u.Is(1, strings.Count(log, "\n"), "single failure for empty Factory")
+	u.Like(log, "empty Factory logged", "*empty")
+	imported, _ := reg.NewFactory().Import(NewTraceID(""), 2)
+	imported.(*Span).AddAttributes(map[string]interface{}{"a": 1, "b": 2})
+	log = string(logs.ReadAll())
+	u.Is(1, strings.Count(log, "\n"), "single failure for imported Factory")
+	u.Like(log, "imported Factory logged", "*Import")
+}
+
+func TestAddAttributesLimit(t *testing.T) {
+	u, logs, _, reg := fakeSetup(t, "SPAN_MAX_ATTRIBUTES", "3")
+
+	attrs := map[string]interface{}{"e": 5, "b": 2, "d": 4, "a": 1, "c": 3}
+	for i := 0; i < 20; i++ {
+		sp := reg.NewFactory().NewSpan().(*Span)
+		sp.AddAttributes(attrs)
+		kept := make([]string, 0, 3)
+		for key := range sp.details.Attributes.AttributeMap {
+			kept = append(kept, key)
+		}
+		sort.Strings(kept)
+		if !u.Is("[a b c]", fmt.Sprint(kept), u.S("same kept keys ", i)) {
+			break
+		}
+		u.Like(logs.ReadAll(), "cap warned", "*attribute")
+		sp.Finish()
+	}
+}
+
+func TestDrain(t *testing.T) {
+	u, logs, ft, reg := fakeSetup(t, "SPAN_RUNNERS", "4", "SPAN_BATCH_DUR", "1h")
+	fact := reg.NewFactory()
+
+	for i := 0; i < 50; i++ {
+		fact.NewSpan().Finish()
+	}
+	ctx, can := context.WithTimeout(context.Background(), 5*time.Second)
+	defer can()
+	u.Is(nil, reg.Drain(ctx), "drain after burst")
+	u.Is(50, len(ft.spans()), "burst written by drain")
+
+	// Drain concurrently with Finish() and with other Drain()s:
+	var wg sync.WaitGroup
+	errs := make(chan error, 3)
+	for g := 0; g < 3; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				fact.NewSpan().Finish()
+			}
+			errs <- reg.Drain(ctx)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		u.Is(nil, err, "concurrent drain")
+	}
+	u.Is(80, len(ft.spans()), "all spans written by concurrent drains")
+
+	ft.setDelay(time.Second / 4)
+	fact.NewSpan().Finish()
+	short, can2 := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer can2()
+	start := time.Now()
+	err := reg.Drain(short)
+	u.Like(err, "drain timeout", "Drain[(][)] gave up", "of 4 runners idle")
+	u.Is(true, errors.Is(err, context.DeadlineExceeded), "wraps ctx error")
+	u.Is(true, time.Since(start) < time.Second/4, "returned at deadline")
+
+	ft.setDelay(0)
+	u.Is(nil, reg.Drain(ctx), "drain after timeout")
+	u.Is(81, len(ft.spans()), "slow span written")
+	u.Is("", logs.ReadAll(), "nothing logged")
+
+	reg.Halt()
+	u.Like(reg.Drain(ctx), "drain after halt", "after Halt")
+}
+
+func TestDrainConcurrent(t *testing.T) {
+	// A tiny queue makes the Drain()s' requests interleave:
+	u, logs, _, reg := fakeSetup(t, "SPAN_RUNNERS", "4",
+		"SPAN_QUEUE_CAPACITY", "1", "SPAN_BATCH_DUR", "1h")
+
+	ctx, can := context.WithTimeout(context.Background(), 5*time.Second)
+	defer can()
+	const drains = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, drains)
+	for d := 0; d < drains; d++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- reg.Drain(ctx)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		u.Is(nil, err, "interleaved drain")
+	}
+	u.Is("", logs.ReadAll(), "nothing logged")
+}
+
+func TestNewSubSpanRemote(t *testing.T) {
+	u, logs, ft, reg := fakeSetup(t)
+	sp := reg.NewFactory().NewTrace().(*Span)
+
+	kid := sp.NewSubSpan().(*Span)
+	u.Is(true, kid.details.SameProcessAsParentSpan, "set by default")
+	remote := sp.NewSubSpanRemote().(*Span)
+	u.Is(false, remote.details.SameProcessAsParentSpan, "cleared if remote")
+	u.Is(sp.GetTraceID(), remote.GetTraceID(), "remote kid's trace")
+	u.Is(sp, remote.parent, "remote kid linked to parent")
+	u.Is(2, sp.details.ChildSpanCount, "both kids counted")
+	u.IsNot(kid.GetSpanID(), remote.GetSpanID(), "distinct kid IDs")
+	u.Is(true, sp.NewSubSpan().(*Span).details.SameProcessAsParentSpan,
+		"default unchanged after remote")
+	remote.Finish()
+	kid.Finish()
+	sp.Finish()
+	reg.WaitForIdleRunners()
+	u.Is(3, len(ft.spans()), "spans written")
+
+	imp, err := reg.NewFactory().Import(NewTraceID(""), 2)
+	u.Is(nil, err, "import")
+	u.Is(false, imp.(*Span).NewSubSpan().(*Span).
+		details.SameProcessAsParentSpan, "not set under imported span")
+
+	empty := reg.NewFactory().(*Span)
+	u.Is(spans.ROSpan{}, empty.NewSubSpanRemote(), "empty parent")
+	u.Like(logs.ReadAll(), "empty parent logs",
+		"Disallowed method called on empty")
+}
+
+func TestMiddleware(t *testing.T) {
+	u, logs, ft, reg := fakeSetup(t)
+
+	var seen string // Span ID found in handler's Context
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(rw http.ResponseWriter, req *http.Request) {
+		_, seen, _ = ContextTraceFields(req.Context())
+		rw.Write([]byte("fine"))
+	})
+	mux.HandleFunc("/fail", func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(500)
+		rw.WriteHeader(200) // Superfluous; status stays 500
+	})
+	mux.HandleFunc("/panic", func(rw http.ResponseWriter, req *http.Request) {
+		panic("oops")
+	})
+	mux.HandleFunc("/abort", func(rw http.ResponseWriter, req *http.Request) {
+		panic(http.ErrAbortHandler)
+	})
+	var ifaces string // Optional interfaces the handler's writer supports
+	mux.HandleFunc("/ifaces", func(rw http.ResponseWriter, req *http.Request) {
+		ifaces = ""
+		if f, ok := rw.(http.Flusher); ok {
+			ifaces += "F"
+			f.Flush()
+		}
+		if _, ok := rw.(http.Hijacker); ok {
+			ifaces += "H"
+		}
+		if _, ok := rw.(http.Pusher); ok {
+			ifaces += "P"
+		}
+	})
+	handler := Middleware(reg)(mux)
+	serve := func(req *http.Request) (*httptest.ResponseRecorder, *ct2.Span) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		reg.WaitForIdleRunners()
+		all := ft.spans()
+		if !u.Is(1, len(all), u.S("one span for ", req.URL.Path)) {
+			return rec, &ct2.Span{}
+		}
+		ft.mu.Lock()
+		ft.batches = nil
+		ft.mu.Unlock()
+		return rec, all[0]
+	}
+	statusAttr := func(sp *ct2.Span) interface{} {
+		if v, ok := sp.Attributes.AttributeMap[AttrHTTPStatusCode]; ok {
+			return v.IntValue
+		}
+		return nil
+	}
+
+	rec, sp := serve(httptest.NewRequest("GET", "/ok?x=1", nil))
+	u.Is(200, rec.Code, "ok response")
+	u.Is("fine", rec.Body.String(), "ok body")
+	u.Is("SERVER", sp.SpanKind, "ok kind")
+	u.Is("GET /ok", sp.DisplayName.Value, "ok name")
+	u.Is(200, statusAttr(sp), "ok status attribute")
+	u.Is(nil, sp.Status, "ok leaves status unset")
+	u.Is(sp.SpanId, seen, "span stored in handler's Context")
+	u.Is("", sp.ParentSpanId, "new trace has no parent")
+	u.Is("/ok", sp.Attributes.AttributeMap[AttrHTTPURL].StringValue.Value,
+		"ok URL without query")
+	_, ok := sp.Attributes.AttributeMap[AttrHTTPRoute]
+	u.Is(false, ok, "no route without WithRoute()")
+
+	rec, sp = serve(httptest.NewRequest("POST", "/fail", nil))
+	u.Is(500, rec.Code, "fail response")
+	u.Is(500, statusAttr(sp), "fail status attribute")
+	if u.IsNot(nil, sp.Status, "fail status set") {
+		u.Is(int64(codes.Internal), sp.Status.Code, "fail status code")
+	}
+
+	req := httptest.NewRequest("GET", "/ok", nil)
+	req.Header.Set(spans.TraceHeader,
+		"0123456789abcdef0123456789abcdef/255")
+	_, sp = serve(req)
+	u.Like(sp.Name, "imported trace", "/traces/0123456789abcdef0123456789abcdef/")
+	u.Is(spans.HexSpanID(255), sp.ParentSpanId, "imported parent")
+	u.Is(false, sp.SameProcessAsParentSpan, "remote parent")
+
+	for _, tc := range []struct {
+		want string
+		rw   http.ResponseWriter
+	}{
+		{"F", httptest.NewRecorder()},
+		{"", struct{ http.ResponseWriter }{httptest.NewRecorder()}},
+		{"FH", hijackRecorder{httptest.NewRecorder()}},
+		{"FHP", struct {
+			hijackRecorder
+			http.Pusher
+		}{hijackRecorder{httptest.NewRecorder()}, nil}},
+		{"P", struct {
+			http.ResponseWriter
+			http.Pusher
+		}{httptest.NewRecorder(), nil}},
+		{"HP", struct {
+			http.ResponseWriter
+			http.Hijacker
+			http.Pusher
+		}{httptest.NewRecorder(), nil, nil}},
+	} {
+		handler.ServeHTTP(tc.rw, httptest.NewRequest("GET", "/ifaces", nil))
+		u.Is(tc.want, ifaces, "interfaces passed through for "+tc.want)
+	}
+	reg.WaitForIdleRunners()
+	ft.mu.Lock()
+	ft.batches = nil
+	ft.mu.Unlock()
+
+	func() {
+		defer func() {
+			u.Is("oops", recover(), "panic resumed")
+		}()
+		handler.ServeHTTP(httptest.NewRecorder(),
+			httptest.NewRequest("GET", "/panic", nil))
+	}()
+	reg.WaitForIdleRunners()
+	if all := ft.spans(); u.Is(1, len(all), "panic span written") {
+		sp = all[0]
+		u.Is(500, statusAttr(sp), "panic status attribute")
+		if u.IsNot(nil, sp.Status, "panic status set") {
+			u.Is(int64(codes.Internal), sp.Status.Code, "panic status code")
+			u.Like(sp.Status.Message, "panic message",
+				"^panic: oops\n", "goroutine", "[.]TestMiddleware[.]func")
+		}
+	}
+	ft.mu.Lock()
+	ft.batches = nil
+	ft.mu.Unlock()
+
+	func() {
+		defer func() {
+			u.Is(http.ErrAbortHandler, recover(), "abort resumed")
+		}()
+		handler.ServeHTTP(httptest.NewRecorder(),
+			httptest.NewRequest("GET", "/abort", nil))
+	}()
+	reg.WaitForIdleRunners()
+	if all := ft.spans(); u.Is(1, len(all), "abort span written") {
+		sp = all[0]
+		u.Is(nil, statusAttr(sp), "abort sent no status")
+		if u.IsNot(nil, sp.Status, "abort status set") {
+			u.Is(int64(codes.Aborted), sp.Status.Code, "abort not INTERNAL")
+			u.Is("response aborted", sp.Status.Message, "abort message")
+		}
+	}
+	ft.mu.Lock()
+	ft.batches = nil
+	ft.mu.Unlock()
+
+	handler = Middleware(reg, WithRoute(func(req *http.Request) string {
+		if strings.HasPrefix(req.URL.Path, "/ok") {
+			return "/ok"
+		}
+		return ""
+	}))(mux)
+	_, sp = serve(httptest.NewRequest("GET", "/ok", nil))
+	route, ok := sp.Attributes.AttributeMap[AttrHTTPRoute]
+	if u.Is(true, ok, "route recorded") {
+		u.Is("/ok", route.StringValue.Value, "route from WithRoute()")
+	}
+	_, sp = serve(httptest.NewRequest("GET", "/fail", nil))
+	_, ok = sp.Attributes.AttributeMap[AttrHTTPRoute]
+	u.Is(false, ok, "empty route not recorded")
+	u.Is("", logs.ReadAll(), "nothing logged")
+}
+
+// hijackRecorder is an httptest.ResponseRecorder that claims to support
+// http.Hijacker.
+//
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+func (hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, errors.New("not really")
+}
+
+func TestRetryCount(t *testing.T) {
+	u, logs, ft, reg := fakeSetup(t)
+	retries := func(sp *Span) interface{} {
+		if nil == sp.details.Attributes {
+			return nil
+		}
+		if v, ok := sp.details.Attributes.AttributeMap[AttrRetryCount]; ok {
+			return v.IntValue
+		}
+		return nil
+	}
+
+	sp := reg.NewFactory().NewTrace().(*Span)
+	u.Is(sp, sp.SetRetryCount(0), "SetRetryCount() returns Factory")
+	u.Is(nil, retries(sp), "zero count not recorded")
+	sp.SetRetryCount(3)
+	u.Is(3, retries(sp), "count set")
+	sp.IncRetryCount()
+	u.Is(4, retries(sp), "set count incremented")
+	sp.SetRetryCount(2)
+	u.Is(2, retries(sp), "count replaced")
+	sp.Finish()
+
+	sp = reg.NewFactory().NewTrace().(*Span)
+	sp.Concurrent()
+	u.Is(sp, sp.IncRetryCount(), "IncRetryCount() returns Factory")
+	u.Is(1, retries(sp), "incremented from zero")
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 25; i++ {
+				sp.IncRetryCount()
+			}
+		}()
+	}
+	wg.Wait()
+	u.Is(101, retries(sp), "concurrent increments")
+	sp.Finish()
+	reg.WaitForIdleRunners()
+	all := ft.spans()
+	if u.Is(2, len(all), "spans written") {
+		u.Is(2, all[0].Attributes.AttributeMap[AttrRetryCount].IntValue,
+			"count registered")
+	}
+	u.Is("", logs.ReadAll(), "nothing logged")
+
+	empty := reg.NewFactory().(*Span)
+	u.Is(empty, empty.SetRetryCount(5), "empty set returns Factory")
+	u.Is(empty, empty.IncRetryCount(), "empty inc returns Factory")
+	u.Is(nil, empty.details, "empty Factory unchanged")
+	u.Is("", logs.ReadAll(), "empty Factory is silent")
+
+	sp.IncRetryCount()
+	u.Like(logs.ReadAll(), "finished span logs",
+		"Disallowed method called on Finish[(][)]ed")
+	u.Is(101, retries(sp), "finished span unchanged")
+}
+
+func TestRegistrarProject(t *testing.T) {
+	u := tutl.New(t)
+
+	ft := newFakeTrace()
+	defer ft.srv.Close()
+
+	lookups := 0
+	lookupErr := errors.New("no GCP metadata here")
+	var lookupProj string
+	orig := gcpProjectID
+	defer func() { gcpProjectID = orig }()
+	gcpProjectID = func(_ lager.Ctx) (string, error) {
+		lookups++
+		if "" == lookupProj {
+			return "", lookupErr
+		}
+		return lookupProj, nil
+	}
+	project := func(arg string) (string, error) {
+		reg, err := NewRegistrar(arg, ft.client())
+		if nil != err {
+			return "", err
+		}
+		reg.Halt()
+		return reg.proj, nil
+	}
+
+	t.Setenv("SPAN_PROJECT", "span-proj")
+	t.Setenv("GOOGLE_CLOUD_PROJECT", "cloud-proj")
+	lookupProj = "meta-proj"
+	p, err := project("")
+	u.Is(nil, err, "SPAN_PROJECT error")
+	u.Is("span-proj", p, "SPAN_PROJECT wins")
+	p, _ = project("arg-proj")
+	u.Is("arg-proj", p, "explicit project wins over env")
+
+	t.Setenv("SPAN_PROJECT", "")
+	p, _ = project("")
+	u.Is("cloud-proj", p, "GOOGLE_CLOUD_PROJECT used")
+	u.Is(0, lookups, "no lookup when env set")
+
+	t.Setenv("GOOGLE_CLOUD_PROJECT", "")
+	p, err = project("")
+	u.Is(nil, err, "metadata error")
+	u.Is("meta-proj", p, "metadata fallback")
+	u.Is(1, lookups, "looked up")
+
+	lookupProj = ""
+	_, err = project("")
+	u.Is(lookupErr, err, "lookup error returned")
+
+	t.Setenv("SPAN_PROJECT", "span-proj")
+	t.Setenv("SPAN_SAMPLE_RATE", "0")
+	reg, err := NewRegistrar("", ft.client())
+	if u.Is(nil, err, "tracing off without metadata") {
+		u.Is(false, reg.NewFactory().NewTrace().(*Span).IsSampled(),
+			"nothing sampled")
+		reg.Halt()
+	}
+}
@@ -12,28 +12,54 @@ import (
 	"context"
 	crand "crypto/rand"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	mrand "math/rand"
 	"net/http"
 	"os"
+	"runtime"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/Unity-Technologies/go-lager-internal"
 	spans "github.com/Unity-Technologies/go-lager-internal/gcp-spans"
 	"github.com/Unity-Technologies/tools-gcp-internal/conn"
 	"github.com/Unity-Technologies/tools-gcp-internal/metric"
 	ct2 "google.golang.org/api/cloudtrace/v2"
+	rpc "google.golang.org/genproto/googleapis/rpc/code"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	//  api "google.golang.org/api/googleapi"
 )
 
 const ZuluTime = "2006-01-02T15:04:05.999999Z"
 
+// ZuluTimeNano is like ZuluTime but keeps nanoseconds instead of truncating
+// to microseconds.  Trailing zeros are still trimmed.
+const ZuluTimeNano = "2006-01-02T15:04:05.999999999Z"
+
+// SpanTimeLayout is the layout used to format the StartTime and EndTime of
+// spans being registered.  It defaults to ZuluTimeNano so that very short
+// spans do not end up with identical timestamps.  Set it to ZuluTime to
+// only keep microseconds.
+//
+var SpanTimeLayout = ZuluTimeNano
+
 func TimeAsString(when time.Time) string {
 	return when.In(time.UTC).Format(ZuluTime)
 }
 
+// spanTime() formats 'when' for a span's StartTime or EndTime.
+func spanTime(when time.Time) string {
+	return when.In(time.UTC).Format(SpanTimeLayout)
+}
+
 type Stringer interface {
 	String() string
 }
@@ -50,15 +76,22 @@ type Client struct {
 // A Span object is expected to be modified only from a single goroutine
 // and so no locking is implemented.  Creation of sub-spans does implement
 // locking so that multiple go routines can safely create sub-spans from
-// the same span without additional locking.
+// the same span without additional locking.  Call Concurrent() on a
+// span that will have attributes added to it from multiple goroutines.
 //
 type Span struct {
 	spans.ROSpan
-	ch      chan<- Span
-	start   time.Time
-	end     time.Time
-	parent  *Span
-	details *ct2.Span
+	ch        chan<- Span
+	reg       *Registrar
+	start     time.Time
+	end       time.Time
+	parent    *Span
+	details   *ct2.Span
+	unsampled bool          // Whether the trace was not chosen to be registered
+	safeAttr  bool          // Whether Concurrent() was called (lock attribute changes)
+	enqueued  time.Time     // When Finish() queued the span to be registered
+	nameWarn  bool          // Whether a truncated display name was logged
+	release   chan struct{} // Closed when Drain() lets idle runners resume
 
 	mu      *sync.Mutex // Lock used by NewSubSpan() for below items:
 	spanInc uint64      // Amount to increment to make next span ID.
@@ -72,14 +105,97 @@ type Span struct {
 // manipulate spans.
 //
 type Registrar struct {
-	proj    string
-	runners int
-	queue   chan<- Span
-	dones   <-chan bool
+	proj       string
+	runners    int
+	queue      chan<- Span
+	dones      <-chan bool
+	sampleRate float64      // Fraction of new traces to register
+	header     atomic.Value // Holds a string; if not "", overrides TraceHeader
+	health     *writeHealth
+	maxAttrs   int           // See SPAN_MAX_ATTRIBUTES
+	onDrop     atomic.Value  // Holds a dropHook; see OnSpanDropped()
+	domain     string        // "domain" label for metrics
+	draining   chan struct{} // Holds a value during Drain()
+}
+
+// dropHook is the type of function passed to OnSpanDropped().
+//
+type dropHook func(sp Span, reason string)
+
+// heldSpan is a span that a runner has read, along with the OnSpanDropped()
+// hook (never 'nil') that was in place when the runner read it.
+//
+type heldSpan struct {
+	sp     Span
+	onDrop dropHook
 }
 
+// writeHealth tracks the results of the runners' BatchWrite calls.
+//
+type writeHealth struct {
+	mu       sync.Mutex
+	lastOK   time.Time // Last successful write (or when runners started)
+	lastFail time.Time // Last failed write
+	lastErr  error     // Error from last failed write
+	failing  time.Time // First failure since last success; zero if none
+}
+
+// record() notes the result of one BatchWrite call.
+//
+func (h *writeHealth) record(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if nil == err {
+		h.lastOK = time.Now()
+		h.failing = time.Time{}
+	} else {
+		h.lastFail = time.Now()
+		h.lastErr = err
+		if h.failing.IsZero() {
+			h.failing = h.lastFail
+		}
+	}
+}
+
+// TraceHeader is the name of the HTTP header that ImportFromHeaders() and
+// SetHeader() use to carry the trace context.  It defaults to the GCP
+// "X-Cloud-Trace-Context" header but can be changed, such as when proxies
+// rewrite that header to a custom name.  Use Registrar.SetTraceHeader() to
+// override it for the spans of just one Registrar.
+//
+var TraceHeader = spans.TraceHeader
+
+// MaxAttributes is the most attributes that AddAttribute() [and so also
+// AddPairs(), etc.] will store on a single span.  It defaults to the limit
+// that GCP CloudTrace imposes.  Further new attribute keys are discarded and
+// counted in the span's DroppedAttributesCount.  Only the first such drop
+// for each span is logged.  A Registrar uses SPAN_MAX_ATTRIBUTES instead, if
+// that is set when the Registrar is created [see NewRegistrar()].
+//
+var MaxAttributes = 32
+
+// MaxDisplayNameBytes is the longest display name (in bytes) that
+// CloudTrace keeps.  SetDisplayName() truncates longer names itself.
+const MaxDisplayNameBytes = 128
+
+// StripDisplayNameQuery can be set to 'true' to have SetDisplayName() drop
+// everything starting at the first '?' of a name, such as the query string
+// of a URL, which are often long and vary so much as to make names less
+// useful.
+//
+var StripDisplayNameQuery = false
+
 var warnOnce sync.Once
 
+// How often to log about invalid spans (per domain and reason) and when we
+// last did.
+var invalidWarnPeriod = time.Minute
+var invalidWarned = make(map[invalidKey]time.Time)
+var invalidMu sync.Mutex
+
+// invalidKey is what warnings about invalid spans are throttled by.
+type invalidKey struct{ domain, reason string }
+
 // NewSpanID() just generates a random uint64 value.  You are never expected
 // to call this directly.  It prefers to use cryptographically strong random
 // values but will resort to math/rand.Uint64() if that fails.  Such a
@@ -135,12 +251,18 @@ func NewTraceID(oldTraceID string) string {
 // service using default options.  If 'svc' is not 'nil', then 'ctx' is
 // ignored.
 //
+// Creating the base service can hang for a long time if looking up
+// credentials stalls (such as when the metadata server is not reachable).
+// If 'ctx' has no deadline of its own, then NewClient() gives up after
+// TRACE_CLIENT_TIMEOUT (default "10s") and returns an error.  If 'ctx' has
+// a deadline, then NewClient() gives up when 'ctx' is done.
+//
 func NewClient(ctx context.Context, svc *ct2.Service) (Client, error) {
 	if nil == svc {
 		if nil == ctx {
 			ctx = context.Background()
 		}
-		if newSvc, err := ct2.NewService(ctx); nil != err {
+		if newSvc, err := newTraceService(ctx); nil != err {
 			return Client{}, err
 		} else {
 			svc = newSvc
@@ -149,6 +271,58 @@ func NewClient(ctx context.Context, svc *ct2.Service) (Client, error) {
 	return Client{ts: ct2.NewProjectsTracesService(svc)}, nil
 }
 
+// newService is what creates the base CloudTrace service (replaced in
+// tests to simulate a stuck credential lookup).
+var newService = ct2.NewService
+
+// gcpProjectID is how NewRegistrar() finds the default project (replaced
+// in tests to simulate having or lacking GCP metadata).
+var gcpProjectID = lager.GcpProjectID
+
+// newTimer is how each runner starts the timer for writing a partial batch.
+// It returns the timer's channel and a function to stop it (replaced in tests
+// to fire timeouts explicitly).
+var newTimer = func(d time.Duration) (<-chan time.Time, func() bool) {
+	t := time.NewTimer(d)
+	return t.C, t.Stop
+}
+
+// newTraceService() calls newService() but stops waiting for it once
+// 'ctx' is done or, if 'ctx' has no deadline, after TRACE_CLIENT_TIMEOUT.
+// 'ctx' itself is never canceled since the service may hold onto it for
+// refreshing credentials.
+//
+func newTraceService(ctx context.Context) (*ct2.Service, error) {
+	type result struct {
+		svc *ct2.Service
+		err error
+	}
+	ch := make(chan result, 1)
+	create := newService
+	go func() {
+		svc, err := create(ctx)
+		ch <- result{svc, err}
+	}()
+
+	var expired <-chan time.Time
+	timeout := conn.EnvDuration("TRACE_CLIENT_TIMEOUT", "10s")
+	if _, ok := ctx.Deadline(); !ok {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case res := <-ch:
+		return res.svc, res.err
+	case <-expired:
+		return nil, fmt.Errorf("Timed out after %v creating CloudTrace"+
+			" service (TRACE_CLIENT_TIMEOUT); check GCP credentials", timeout)
+	case <-ctx.Done():
+		return nil, fmt.Errorf("Gave up creating CloudTrace service"+
+			" (check GCP credentials): %w", ctx.Err())
+	}
+}
+
 // MustNewClient() calls NewClient().  If that fails, then lager.Exit() is
 // used to log the error and abort the process.
 //
@@ -194,26 +368,158 @@ func StartServer(
 // NewRegistrar() starts a number of go-routines that wait to receive
 // Finish()ed Spans and then register them with GCP Cloud Trace.
 //
-func NewRegistrar(project string, client Client) (*Registrar, error) {
+// Spans are written in batches.  A batch is written once it contains
+// SPAN_BATCH_SIZE spans (default 10000) or once SPAN_BATCH_DUR (default
+// "5s") times a random multiplier has passed since the first span was
+// added to it.  The random multiplier is between SPAN_BATCH_JITTER_MIN
+// (default 1.0) and SPAN_BATCH_JITTER_MAX (default 1.5).  A batch is also
+// written early, before adding a span that would make the batch's estimated
+// size exceed SPAN_BATCH_BYTES (default 5 MiB), to stay under the API's
+// request size limit.
+//
+// Setting SPAN_RUNNER_STAGGER to a fraction between 0.0 (the default, no
+// stagger) and 1.0 shortens each runner's first batch by a different random
+// portion of up to that fraction of SPAN_BATCH_DUR, so that runners started
+// together do not keep writing their batches in near-lockstep.  The first
+// batch is never delayed past SPAN_BATCH_DUR due to this.
+//
+// SPAN_MAX_ATTRIBUTES (default MaxAttributes) limits how many attributes
+// are stored on each span.  Values above the CloudTrace limit of 32 are
+// only useful for testing.
+//
+// The SPAN_SAMPLE_RATE environment variable can be set to a value between
+// 0.0 and 1.0 to have only that fraction of new traces be registered
+// (head-based sampling).  The default is 1.0 (every trace is registered).
+// The decision is made when NewTrace() is called and all sub-spans of that
+// trace use the same decision.
+//
+// The metrics about the Registrar's spans are labeled with a "domain" that
+// is the value of the LAGER_SPAN_PREFIX environment variable unless a
+// WithMetricPrefix() option is passed.
+//
+// If 'project' is "", then the SPAN_PROJECT environment variable is used,
+// or else GOOGLE_CLOUD_PROJECT.  If neither is set, then the project is
+// looked up via lager.GcpProjectID() (which uses GCP_PROJECT_ID or the GCP
+// metadata service) and an error is returned if that fails.  So, in local
+// development or CI where tracing should effectively be off, setting
+// SPAN_PROJECT (to any value) plus SPAN_SAMPLE_RATE=0 gives a Registrar
+// that needs no GCP metadata and never registers any spans.  Note that
+// creating the Client may still require credentials.
+//
+func NewRegistrar(
+	project string, client Client, opts ...RegistrarOption,
+) (*Registrar, error) {
+	if "" == project {
+		project = os.Getenv("SPAN_PROJECT")
+	}
 	if "" == project {
-		if dflt, err := lager.GcpProjectID(nil); nil != err {
+		project = os.Getenv("GOOGLE_CLOUD_PROJECT")
+	}
+	if "" == project {
+		if dflt, err := gcpProjectID(nil); nil != err {
 			return nil, err
 		} else {
 			project = dflt
 		}
 	}
-	runners, queue, dones, err := startRegistrar(project, client)
+	rate := EnvFloat(1.0, "SPAN_SAMPLE_RATE")
+	if rate < 0.0 || 1.0 < rate {
+		return nil, fmt.Errorf(
+			"SPAN_SAMPLE_RATE must be between 0.0 and 1.0 not %g", rate)
+	}
+	maxAttrs := EnvInteger(MaxAttributes, "SPAN_MAX_ATTRIBUTES")
+	if maxAttrs < 1 {
+		return nil, fmt.Errorf(
+			"SPAN_MAX_ATTRIBUTES must be at least 1 not %d", maxAttrs)
+	}
+	reg := &Registrar{
+		proj: project, sampleRate: rate, maxAttrs: maxAttrs,
+		health:   &writeHealth{lastOK: time.Now()},
+		domain:   os.Getenv("LAGER_SPAN_PREFIX"),
+		draining: make(chan struct{}, 1),
+	}
+	for _, opt := range opts {
+		opt(reg)
+	}
+	runners, queue, dones, err := startRegistrar(
+		project, client, reg.health, reg.domain)
 	if nil != err {
 		return nil, err
 	}
-	return &Registrar{project, runners, queue, dones}, nil
+	reg.runners, reg.queue, reg.dones = runners, queue, dones
+	return reg, nil
+}
+
+// RegistrarOption is an optional argument to NewRegistrar().
+type RegistrarOption func(*Registrar)
+
+// WithMetricPrefix() returns a RegistrarOption that sets the "domain" label
+// used on the Registrar's span metrics (overriding LAGER_SPAN_PREFIX).  Use
+// it to keep apart the metrics of multiple Registrars in one process.
+//
+func WithMetricPrefix(prefix string) RegistrarOption {
+	return func(r *Registrar) { r.domain = prefix }
+}
+
+// maxAttributes() returns the most attributes to store on each span.
+//
+func (r *Registrar) maxAttributes() int {
+	if nil == r || 0 == r.maxAttrs {
+		return MaxAttributes
+	}
+	return r.maxAttrs
+}
+
+// metricDomain() returns the "domain" label value for span metrics.
+//
+func (r *Registrar) metricDomain() string {
+	if nil == r {
+		return os.Getenv("LAGER_SPAN_PREFIX")
+	}
+	return r.domain
+}
+
+// LastWriteError() returns when the most recent failed attempt to register
+// a batch of spans happened and the error from it.  Returns a zero time and
+// a 'nil' error if no attempt has failed.  The error is kept even after
+// later attempts succeed; see Healthy().
+//
+func (r *Registrar) LastWriteError() (time.Time, error) {
+	if nil == r || nil == r.health {
+		return time.Time{}, nil
+	}
+	r.health.mu.Lock()
+	defer r.health.mu.Unlock()
+	return r.health.lastFail, r.health.lastErr
+}
+
+// Healthy() returns 'false' if the most recent attempt to register a batch
+// of spans failed and its streak of failures started more than 'window'
+// ago.  A Registrar that has had no spans to register is healthy, and time
+// spent idle before a failure does not count against 'window'.  Useful for
+// readiness probes to detect when traces stop flowing (such as when
+// credentials were revoked).
+//
+func (r *Registrar) Healthy(window time.Duration) bool {
+	if nil == r || nil == r.health {
+		return true
+	}
+	r.health.mu.Lock()
+	defer r.health.mu.Unlock()
+	h := r.health
+	if h.failing.IsZero() { // Not currently failing
+		return true
+	}
+	return time.Since(h.failing) <= window
 }
 
 // MustNewRegistrar() calls NewRegistrar() and, if that fails, uses
 // lager.Exit() to abort the process.
 //
-func MustNewRegistrar(project string, client Client) *Registrar {
-	reg, err := NewRegistrar(project, client)
+func MustNewRegistrar(
+	project string, client Client, opts ...RegistrarOption,
+) *Registrar {
+	reg, err := NewRegistrar(project, client, opts...)
 	if nil != err {
 		lager.Exit().MMap("Could not start Registrar for CloudTrace spans",
 			"err", err)
@@ -223,21 +529,63 @@ func MustNewRegistrar(project string, client Client) *Registrar {
 
 // WaitForIdleRunners() is only meant to be used by tests.  It allows you to
 // ensure that all prior Finish()ed Spans have been processed so the test can
-// check for any errors that were logged.
-//
-// It works by sending one request per runner that will cause that runner to
-// wait when it receives it.  Then it reads the responses from all of the
-// runners (which ends their waiting) and then returns.
+// check for any errors that were logged.  It is Drain() with no time limit.
 //
 func (r *Registrar) WaitForIdleRunners() {
-	readys := make(chan Span, 0)
-	empty := Span{ch: readys}
-	for i := r.runners; 0 < i; i-- {
-		r.queue <- empty
+	_ = r.Drain(context.Background())
+}
+
+// Drain() waits until all spans Finish()ed before it was called have been
+// written to GCP (or dropped), such as before a batch job exits.  Every
+// runner writes its partial batch, even if it is not yet full.
+//
+// It works by sending one request per runner that causes that runner to
+// flush its batch, acknowledge, and then wait.  Once all of the runners have
+// acknowledged (or 'ctx' is done), it lets them all resume.  Having each runner
+// wait ensures that no runner can take two of the requests.
+//
+// If 'ctx' is done before every runner acknowledges, then Drain() returns
+// an error wrapping ctx.Err() and the remaining runners resume on their own
+// once they get to the request.  It returns an error if Halt() has already
+// been called.  Drain() is safe to call while spans are being Finish()ed
+// and from multiple goroutines, but not concurrently with Halt().  Calls
+// from multiple goroutines take turns; otherwise the runners could each
+// end up waiting on a different call's requests.  Time spent waiting for
+// an earlier call counts against 'ctx'.
+//
+func (r *Registrar) Drain(ctx context.Context) error {
+	queue, runners := r.queue, r.runners
+	if nil == queue {
+		return errors.New("Drain() called after Halt()")
 	}
-	for i := r.runners; 0 < i; i-- {
-		<-readys
+	select {
+	case r.draining <- struct{}{}:
+		defer func() { <-r.draining }()
+	case <-ctx.Done():
+		return fmt.Errorf("Drain() gave up waiting for another Drain(): %w",
+			ctx.Err())
 	}
+	acks := make(chan Span, runners)
+	release := make(chan struct{})
+	defer close(release)
+	marker := Span{ch: acks, release: release}
+	sent, acked := 0, 0
+	for acked < runners {
+		send := queue
+		if runners <= sent {
+			send = nil // All requests sent; just wait for acks
+		}
+		select {
+		case send <- marker:
+			sent++
+		case <-acks:
+			acked++
+		case <-ctx.Done():
+			return fmt.Errorf("Drain() gave up with %d of %d runners idle: %w",
+				acked, runners, ctx.Err())
+		}
+	}
+	return nil
 }
 
 // WaitForRunnerRead() is only meant to be used by tests.  It allows you to
@@ -257,15 +605,82 @@ func (r *Registrar) WaitForRunnerRead() {
 
 // newSpan() initializes and returns a new *Span.
 //
-func newSpan(roSpan spans.ROSpan, ch chan<- Span) *Span {
-	return &Span{ROSpan: roSpan, ch: ch, mu: new(sync.Mutex)}
+func newSpan(roSpan spans.ROSpan, ch chan<- Span, reg *Registrar) *Span {
+	return &Span{ROSpan: roSpan, ch: ch, reg: reg, mu: new(sync.Mutex)}
+}
+
+// sample() returns whether a new trace should be registered.
+//
+func (r *Registrar) sample() bool {
+	if nil == r || 1.0 <= r.sampleRate {
+		return true
+	}
+	return mrand.Float64() < r.sampleRate
+}
+
+// SetTraceHeader() sets the name of the HTTP header used to carry the trace
+// context for all Factories from this Registrar, overriding TraceHeader.
+// Passing "" reverts to using TraceHeader.  It is safe to call at any time,
+// but Factories importing or propagating trace context while the name is
+// changed may use either name, so it is best called before any Factories
+// are used.
+//
+func (r *Registrar) SetTraceHeader(name string) {
+	r.header.Store(name)
+}
+
+// traceHeader() returns the name of the HTTP header to carry the trace
+// context in.
+//
+func (r *Registrar) traceHeader() string {
+	if nil == r {
+		return TraceHeader
+	}
+	if name, _ := r.header.Load().(string); "" != name {
+		return name
+	}
+	return TraceHeader
+}
+
+// OnSpanDropped() sets a function to be called for each Finish()ed span
+// that does not get registered with GCP.  'reason' will be one of:
+//
+//      "unsampled"     - The trace was not chosen by SPAN_SAMPLE_RATE.
+//      "queue_full"    - The runners' queue had no room for the span.
+//      "invalid"       - The span was missing required data.
+//      "write_failed"  - The BatchWrite call that included it failed.
+//      "write_timeout" - The BatchWrite call hit SPAN_CREATE_TIMEOUT.
+//
+// The hook is called from the goroutine that called Finish() or from one of
+// the runners, without holding any locks.  It must be fast and must never
+// block, or it will delay Finish() or stall the registering of all spans.
+// Passing 'nil' removes the hook (the default), in which case dropped spans
+// incur no extra overhead.  It is safe to call while spans are being
+// Finish()ed, but a span that a runner has already read gets the hook (if
+// any) that was set when the runner read it.
+//
+func (r *Registrar) OnSpanDropped(hook func(sp Span, reason string)) {
+	r.onDrop.Store(dropHook(hook))
+}
+
+// dropHook() returns the function set via OnSpanDropped() (or 'nil').
+//
+func (r *Registrar) dropHook() dropHook {
+	if nil == r {
+		return nil
+	}
+	hook, _ := r.onDrop.Load().(dropHook)
+	return hook
 }
 
 // NewFactory() returns a spans.Factory that can be used to create and
 // manipulate spans and eventually register them with GCP Cloud Trace.
 //
+// The returned Factory can be stored and shared so that multiple go
+// routines can call NewSpan() or NewTrace() on it at the same time.
+//
 func (r *Registrar) NewFactory() spans.Factory {
-	return newSpan(spans.NewROSpan(r.proj), r.queue)
+	return newSpan(spans.NewROSpan(r.proj), r.queue, r)
 }
 
 // Halt() tells the runners to terminate and waits for them all to finish
@@ -274,7 +689,8 @@ func (r *Registrar) NewFactory() spans.Factory {
 // Halt() should only be called after you are sure that no more spans will
 // be Finish()ed.  Any spans Finish()ed after Halt() has been called may
 // cause a panic().  Not waiting for Halt() to return can mean that recently
-// Finish()ed spans might not be registered.
+// Finish()ed spans might not be registered.  Each runner writes its partial
+// batch of spans (if any) before terminating.
 //
 func (r *Registrar) Halt() {
 	if nil == r.queue {
@@ -287,6 +703,26 @@ func (r *Registrar) Halt() {
 	}
 }
 
+// EnvFloat() gets a configuration 'float64' value from the specified
+// environment variable, returning the 'tacit' value if not set.
+//
+func EnvFloat(tacit float64, envvar string) float64 {
+	if "" == envvar {
+		lager.Exit().WithCaller(1).List(
+			"Empty environment variable name passed to EnvFloat()")
+	}
+	val := os.Getenv(envvar)
+	if "" == val {
+		return tacit
+	}
+	f, err := strconv.ParseFloat(val, 64)
+	if nil != err {
+		lager.Exit().MMap("Invalid float value",
+			"EnvVar", envvar, "Value", val, "Error", err)
+	}
+	return f
+}
+
 // EnvInteger() gets a configuration 'int' value from the specified
 // environment variable, returning the 'tacit' value if not set.
 //
@@ -308,137 +744,446 @@ func EnvInteger(tacit int, envvar string) int {
 }
 
 func startRegistrar(
-	project string, client Client,
+	project string, client Client, health *writeHealth, domain string,
 ) (int, chan<- Span, <-chan bool, error) {
 	runners := EnvInteger(2, "SPAN_RUNNERS")
 	queue := make(chan Span, EnvInteger(1000, "SPAN_QUEUE_CAPACITY"))
 	dones := make(chan bool, runners)
-	path := "projects/" + project
-	maxSpans := EnvInteger(10000, "SPAN_BATCH_SIZE")
-	maxBatchDur := conn.EnvDuration("SPAN_BATCH_DUR", "5s")
-	maxLag := conn.EnvDuration("SPAN_CREATE_TIMEOUT", "10s")
+	conf := batchConf{
+		maxSpans:    EnvInteger(10000, "SPAN_BATCH_SIZE"),
+		maxBytes:    EnvInteger(5*1024*1024, "SPAN_BATCH_BYTES"),
+		maxBatchDur: conn.EnvDuration("SPAN_BATCH_DUR", "5s"),
+		maxLag:      conn.EnvDuration("SPAN_CREATE_TIMEOUT", "10s"),
+		jitterMin:   EnvFloat(1.0, "SPAN_BATCH_JITTER_MIN"),
+		jitterMax:   EnvFloat(1.5, "SPAN_BATCH_JITTER_MAX"),
+		domain:      domain,
+	}
+	if conf.jitterMin < 1.0 || conf.jitterMax < conf.jitterMin {
+		return 0, nil, nil, fmt.Errorf("Need 1.0 <= SPAN_BATCH_JITTER_MIN"+
+			" (%g) <= SPAN_BATCH_JITTER_MAX (%g)",
+			conf.jitterMin, conf.jitterMax)
+	}
+	stagger := EnvFloat(0.0, "SPAN_RUNNER_STAGGER")
+	if stagger < 0.0 || 1.0 < stagger {
+		return 0, nil, nil, fmt.Errorf(
+			"SPAN_RUNNER_STAGGER must be between 0.0 and 1.0 not %g", stagger)
+	}
 	capacity, err := metric.NewCapacityUsage(
-		float64(cap(queue)), "span-queue", os.Getenv("LAGER_SPAN_PREFIX"), "1m")
+		float64(cap(queue)), "span-queue", conf.domain, "1m")
 	if nil != err {
 		lager.Exit().MMap("Can't monitor span queue capacity", "error", err)
 	}
 	for r := runners; 0 < r; r-- {
-		go writeSpans(
-			client, queue, dones, path, maxSpans, maxBatchDur, maxLag, capacity)
+		rc := conf
+		rc.phase = conf.runnerPhase(stagger, r-1, runners)
+		go writeSpans(client, queue, dones, project, rc, capacity, health)
 	}
 	return runners, queue, dones, nil
 }
 
+// batchConf holds the settings that control how each runner collects
+// spans into batches before writing them.
+//
+type batchConf struct {
+	maxSpans    int           // Write a batch once it holds this many spans
+	maxBytes    int           // Or before it would grow past this many bytes
+	maxBatchDur time.Duration // Write a batch after roughly this long
+	maxLag      time.Duration // How long to wait for BatchWrite to finish
+	jitterMin   float64       // Range of random multipliers applied to
+	jitterMax   float64       //   maxBatchDur: [jitterMin,jitterMax)
+	domain      string        // Used to label metrics; see WithMetricPrefix()
+	phase       time.Duration // How much sooner to write the first batch
+}
+
+// runnerPhase() returns how much to shorten the first batch of runner
+// number 'r' (of 'runners').  Each runner gets a random point in its own
+// slice of the first 'stagger' fraction of maxBatchDur so that the runners'
+// phases always differ.  Returns 0 if 'stagger' is 0.
+//
+func (bc batchConf) runnerPhase(stagger float64, r, runners int) time.Duration {
+	if stagger <= 0.0 || runners < 1 {
+		return 0
+	}
+	slice := stagger * float64(bc.maxBatchDur) / float64(runners)
+	return time.Duration((float64(r) + mrand.Float64()) * slice)
+}
+
+// flushAfter() returns how long to wait before writing a partial batch,
+// which is maxBatchDur times a random value in [jitterMin,jitterMax).
+//
+func (bc batchConf) flushAfter() time.Duration {
+	jitter := bc.jitterMin + mrand.Float64()*(bc.jitterMax-bc.jitterMin)
+	return time.Duration(jitter * float64(bc.maxBatchDur))
+}
+
+// spanSize() returns the estimated number of bytes that 'sp' adds to the
+// size of a BatchWrite request.  Since it is called for every span that is
+// written, it adds up the sizes of the fields that this package sets rather
+// than encoding the span as JSON.  The estimate is never smaller than the
+// encoded size of those fields.  Any other parts of the span are encoded.
+//
+func spanSize(sp *ct2.Span) int {
+	const num = 22 // Room for any int64 value, even quoted
+	size := 3      // "{}" plus a comma
+	field := func(key string, valSize int) {
+		size += len(key) + 4 + valSize // `"key":val,`
+	}
+	str := func(key, val string) {
+		if "" != val {
+			field(key, jsonStringSize(val))
+		}
+	}
+	trunc := func(ts *ct2.TruncatableString) int {
+		return 2 + len("truncatedByteCount") + 4 + num +
+			len("value") + 4 + jsonStringSize(ts.Value)
+	}
+	str("name", sp.Name)
+	str("spanId", sp.SpanId)
+	str("parentSpanId", sp.ParentSpanId)
+	str("startTime", sp.StartTime)
+	str("endTime", sp.EndTime)
+	str("spanKind", sp.SpanKind)
+	if nil != sp.DisplayName {
+		field("displayName", trunc(sp.DisplayName))
+	}
+	if 0 != sp.ChildSpanCount {
+		field("childSpanCount", num)
+	}
+	if sp.SameProcessAsParentSpan {
+		field("sameProcessAsParentSpan", len("true"))
+	}
+	if attrs := sp.Attributes; nil != attrs {
+		n := 2 + len("droppedAttributesCount") + 4 + num +
+			len("attributeMap") + 4 + 2
+		for k, v := range attrs.AttributeMap {
+			n += jsonStringSize(k) + 2 + 2 // `"k":{},`
+			if v.BoolValue {
+				n += len("boolValue") + 4 + len("true")
+			}
+			if 0 != v.IntValue {
+				n += len("intValue") + 4 + num
+			}
+			if nil != v.StringValue {
+				n += len("stringValue") + 4 + trunc(v.StringValue)
+			}
+		}
+		field("attributes", n)
+	}
+	if st := sp.Status; nil != st {
+		n := 2 + len("code") + 4 + num + len("details") + 4 + 2
+		if "" != st.Message {
+			n += len("message") + 4 + jsonStringSize(st.Message)
+		}
+		for _, d := range st.Details {
+			n += len(d) + 1
+		}
+		field("status", n)
+	}
+	if nil != sp.Links {
+		field("links", jsonSize(sp.Links))
+	}
+	if nil != sp.StackTrace {
+		field("stackTrace", jsonSize(sp.StackTrace))
+	}
+	if nil != sp.TimeEvents {
+		field("timeEvents", jsonSize(sp.TimeEvents))
+	}
+	return size
+}
+
+// jsonStringSize() returns how many bytes 's' takes up when encoded as a
+// JSON string by encoding/json (including the quotes).
+//
+func jsonStringSize(s string) int {
+	size := 2
+	for i := 0; i < len(s); {
+		if b := s[i]; b < utf8.RuneSelf {
+			switch {
+			case '"' == b, '\\' == b, '\n' == b, '\r' == b, '\t' == b:
+				size += 2
+			case b < 0x20, '<' == b, '>' == b, '&' == b:
+				size += 6 // \u00XX
+			default:
+				size++
+			}
+			i++
+			continue
+		}
+		r, n := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case utf8.RuneError == r && 1 == n:
+			size += 3 // Replaced by U+FFFD
+		case '\u2028' == r, '\u2029' == r:
+			size += 6 // \u202X
+		default:
+			size += n
+		}
+		i += n
+	}
+	return size
+}
+
+// jsonSize() returns how many bytes 'v' takes up when encoded as JSON.
+//
+func jsonSize(v interface{}) int {
+	b, err := json.Marshal(v)
+	if nil != err {
+		return 0
+	}
+	return len(b)
+}
+
+// writeResult() classifies the outcome of a BatchWrite call for the
+// "result" label of the span create_seconds metric:
+//
+//      "ok"        - The call succeeded.
+//      "deadline"  - Our SPAN_CREATE_TIMEOUT deadline ('ctx') expired.
+//      "canceled"  - The call's context was canceled.
+//      "transport" - No HTTP response was received (DNS failure, connection
+//                    refused or timed out, etc.) so GCP may be unreachable.
+//      "fail"      - GCP returned an HTTP error status.
+//
+func writeResult(ctx context.Context, err error) string {
+	switch {
+	case nil == err:
+		return "ok"
+	case context.DeadlineExceeded == ctx.Err(),
+		errors.Is(err, context.DeadlineExceeded):
+		return "deadline"
+	case context.Canceled == ctx.Err(), errors.Is(err, context.Canceled):
+		return "canceled"
+	case 0 == conn.ErrorCode(err):
+		return "transport"
+	}
+	return "fail"
+}
+
 func writeSpans(
 	client Client,
 	queue chan Span,
 	dones chan<- bool,
-	path string,
-	maxSpans int,
-	maxBatchDur, maxLag time.Duration,
+	project string,
+	conf batchConf,
 	capacity *metric.CapacityUsage,
+	health *writeHealth,
 ) {
 	batch := ct2.BatchWriteSpansRequest{
-		Spans: make([]*ct2.Span, 0, maxSpans),
+		Spans: make([]*ct2.Span, 0, conf.maxSpans),
 	}
-	var timer *time.Timer
+	// A new timer is used for each batch.  Reusing one via Reset() would
+	// require reliably draining a value that the old timer may have sent
+	// (or be about to send) so that it can't cause a premature flush of the
+	// next batch.  A stopped (or fired) timer is just dropped instead.
+	var stop func() bool         // Stops the timer, nil unless it is active
 	var timeout <-chan time.Time // nil unless the timer is active
+	stopTimer := func() {
+		if nil != stop {
+			stop()
+		}
+		stop, timeout = nil, nil
+	}
+	halting := false // Whether the queue was closed
+	path := "projects/" + project
+	batchBytes := 0     // Estimated size of the spans in 'batch'
+	var carry *ct2.Span // Span to add after writing the 'batch'
+	carryBytes := 0
+	var held []heldSpan    // Spans in 'batch' to pass to OnSpanDropped() hooks
+	var carrySpan heldSpan // The span for 'carry', if its Registrar has a hook
+	phase := conf.phase    // Only applied to the first batch
 
 	for {
 		// If no active timer and have spans to write:
 		if nil == timeout && 0 < len(batch.Spans) {
-			// Set timeout after maxBatchDur * random[1.0,1.5):
-			dur := time.Duration(
-				(1.0 + mrand.Float64()/2.0) * float64(maxBatchDur))
-			if nil == timer {
-				timer = time.NewTimer(dur)
-			} else {
-				timer.Reset(dur)
+			// Set timeout after maxBatchDur * random[jitterMin,jitterMax):
+			dur := conf.flushAfter()
+			if 0 < phase {
+				dur, phase = conf.maxBatchDur-phase, 0
 			}
-			timeout = timer.C
+			timeout, stop = newTimer(dur)
 			lager.Trace().MMap("Reset span writer timeout")
 		}
 		full := false       // Whether to write the batch now
-		var replySpan *Span // Used by WaitForIdleRunners()
+		trigger := "size"   // What caused the batch to be written
+		var replySpan *Span // Used by Drain()
 
 		// Read more spans to write:
 		select {
 		case sp, ok := <-queue:
 			if !ok {
-				dones <- true
-				return
+				// Write any partial batch before exiting:
+				lager.Trace().MMap("Span queue closed")
+				halting = true
+				full = true
+				trigger = "halt"
+				break
 			}
 			capacity.Record(float64(len(queue)))
-			// Sending an empty Span is used by tests to
-			// wait for the previous work to finish:
+			// Sending an empty Span is used by Drain() (and tests)
+			// to wait for the previous work to finish:
 			if 0 == sp.GetSpanID() {
 				if nil != sp.ch && sp.ch != queue {
 					if 1 == sp.spanInc { // WaitForRunnerRead() called:
 						sp.ch <- sp
 						continue
-					} // Else WaitForIdleRunners() called:
+					} // Else Drain() called:
 					replySpan = &sp
 				}
 				lager.Trace().MMap("Flush span batch")
 				full = true
+				trigger = "flush"
 			} else {
-				lager.Trace().MMap("Add span to batch",
-					"span", sp.details.DisplayName.Value)
+				spanQueued(conf.domain, sp.enqueued)
 				sp.details.Name = path + "/" + sp.GetSpanPath()
-				batch.Spans = append(batch.Spans, sp.details)
+				onDrop := sp.reg.dropHook()
+				if reason := invalidReason(sp.details); "" != reason {
+					spanInvalid(conf.domain, reason)
+					warnInvalid(conf.domain, reason, sp.details)
+					if nil != onDrop {
+						onDrop(sp, "invalid")
+					}
+				} else if size := spanSize(sp.details); 0 < len(batch.Spans) &&
+					conf.maxBytes < batchBytes+size {
+					lager.Trace().MMap("Span batch too big for next span",
+						"span", sp.details.DisplayName.Value)
+					carry, carryBytes = sp.details, size
+					carrySpan = heldSpan{sp, onDrop}
+					full = true
+					trigger = "bytes"
+				} else {
+					lager.Trace().MMap("Add span to batch",
+						"span", sp.details.DisplayName.Value)
+					batch.Spans = append(batch.Spans, sp.details)
+					batchBytes += size
+					if nil != onDrop {
+						held = append(held, heldSpan{sp, onDrop})
+					}
+				}
 			}
 
 		case <-timeout:
 			lager.Trace().MMap("Span batch timed out")
-			timeout = nil // Timer no longer active
+			stop, timeout = nil, nil // Timer no longer active
 			if 0 == len(batch.Spans) {
 				lager.Trace().MMap("Span batch empty after timeout?!")
 				continue
 			}
 			full = true
+			trigger = "timeout"
 		}
 
-		if !full && len(batch.Spans) < maxSpans {
+		if !full && len(batch.Spans) < conf.maxSpans {
 			lager.Trace().MMap("Span batch waiting for more spans")
 			continue
 		}
 
+		stopTimer() // The batch is about to be empty
 		if 0 == len(batch.Spans) {
 			lager.Trace().MMap("No spans to write")
 		} else {
-			if nil != timeout { // Stop the timer
-				if !timer.Stop() {
-					lager.Trace().MMap("Draining unread span timeout")
-					<-timeout
-				}
-				timeout = nil
-			}
 			lager.Trace().MMap("Writing batch of spans",
 				"count", len(batch.Spans))
 
 			// Write the batch of spans now:
 			ctx := context.Background()
-			can := conn.Timeout(&ctx, maxLag)
+			can := conn.Timeout(&ctx, conf.maxLag)
 			start := time.Now()
 			_, err := client.ts.BatchWrite(path, &batch).Context(ctx).Do()
-			if nil == err {
-				spanCreated(start, "ok")
-			} else if nil != ctx.Err() {
-				spanCreated(start, "timeout")
-			} else {
-				spanCreated(start, "fail")
+			health.record(err)
+			result := writeResult(ctx, err)
+			spanCreated(start, project, trigger, result)
+			reason := ""
+			switch result {
+			case "ok":
+			case "deadline":
+				reason = "write_timeout"
+			case "canceled":
+				reason = "write_failed"
+			default:
 				lager.Fail().MMap("Failed to create span batch",
-					"err", err, "spans", len(batch.Spans))
+					"err", err, "code", conn.ErrorCode(err),
+					"result", result, "spans", len(batch.Spans))
+				reason = "write_failed"
 			}
-			batch.Spans = batch.Spans[0:0]
 			can()
+			if "" != reason {
+				for _, h := range held {
+					h.onDrop(h.sp, reason)
+				}
+			}
+			batch.Spans = batch.Spans[0:0]
+			batchBytes = 0
+			held = held[0:0]
+		}
+		if nil != carry {
+			// The carried span counts toward maxSpans for the next batch:
+			batch.Spans = append(batch.Spans, carry)
+			batchBytes = carryBytes
+			carry = nil
+			if nil != carrySpan.onDrop {
+				held = append(held, carrySpan)
+			}
+			carrySpan = heldSpan{}
 		}
 
 		if nil != replySpan {
 			replySpan.ch <- *replySpan
+			<-replySpan.release // Wait until Drain() sees all runners
 			replySpan = nil
 		}
+		if halting {
+			dones <- true
+			return
+		}
+	}
+}
+
+// invalidReason() returns "" if the span looks like it will be accepted by
+// CloudTrace.  Otherwise it returns a short reason for rejecting it.  Only
+// problems that can be detected locally are checked for; CloudTrace reports
+// success for a batch even when it silently ignores invalid spans in it.
+//
+func invalidReason(sp *ct2.Span) string {
+	if "" == sp.SpanId {
+		return "no_span_id"
+	} else if nil == sp.DisplayName || "" == sp.DisplayName.Value {
+		return "no_name"
+	} else if "" == sp.StartTime {
+		return "no_start"
+	} else if "" == sp.EndTime {
+		return "no_end"
+	}
+	start, err := time.Parse(time.RFC3339Nano, sp.StartTime)
+	if nil != err {
+		return "bad_start"
+	}
+	end, err := time.Parse(time.RFC3339Nano, sp.EndTime)
+	if nil != err {
+		return "bad_end"
+	}
+	if end.Before(start) {
+		return "end_before_start"
+	}
+	return ""
+}
+
+// warnInvalid() logs a warning about a span that was dropped for being
+// invalid, but only once per invalidWarnPeriod for each distinct reason
+// (for each Registrar metric 'domain'; see spanQueued()).
+//
+func warnInvalid(domain, reason string, sp *ct2.Span) {
+	key := invalidKey{domain, reason}
+	invalidMu.Lock()
+	now := time.Now()
+	last, ok := invalidWarned[key]
+	if ok && now.Sub(last) < invalidWarnPeriod {
+		invalidMu.Unlock()
+		return
 	}
+	invalidWarned[key] = now
+	invalidMu.Unlock()
+	lager.Warn().MMap("Dropped invalid span", "reason", reason,
+		"domain", domain, "span", sp.Name,
+		"start", sp.StartTime, "end", sp.EndTime)
 }
 
 // ContextPushSpan() takes a Context which should already be decorated with a
@@ -580,10 +1325,30 @@ func PushSpan(
 	return kid
 }
 
+// ContextTraceFields() returns the trace ID and the (hexadecimal) span ID of
+// the span Factory that decorates 'ctx' [see spans.ContextStoreSpan()], so
+// that code that logs but does not otherwise deal with spans can include
+// them.  When spans were pushed onto the Context [such as via PushSpan()],
+// the innermost span's IDs are returned.
+//
+// If 'ctx' is 'nil', is not decorated, or is decorated with an empty Factory,
+// then "", "", and 'false' are returned (and nothing is logged).
+//
+func ContextTraceFields(ctx context.Context) (traceID, spanID string, ok bool) {
+	if nil == ctx {
+		return "", "", false
+	}
+	span := spans.ContextGetSpan(ctx)
+	if nil == span || 0 == span.GetSpanID() {
+		return "", "", false
+	}
+	return span.GetTraceID(), spans.HexSpanID(span.GetSpanID()), true
+}
+
 func (s *Span) initDetails() *Span {
 	s.details = &ct2.Span{SpanId: spans.HexSpanID(s.GetSpanID())}
 	if !s.start.IsZero() {
-		s.details.StartTime = TimeAsString(s.start)
+		s.details.StartTime = spanTime(s.start)
 	}
 	if nil != s.parent {
 		s.details.ParentSpanId = spans.HexSpanID(s.parent.GetSpanID())
@@ -644,6 +1409,19 @@ func (s Span) GetDuration() time.Duration {
 	return s.end.Sub(s.start)
 }
 
+// GetCorrelation() returns "" if the Factory is empty.  Otherwise it
+// returns both the trace and span IDs in a single string so that logs can
+// be correlated with traces using one field.  The value will be in the
+// form "projects/{projectID}/traces/{traceID};{spanID}" where spanID is
+// in hexadecimal.
+//
+func (s Span) GetCorrelation() string {
+	if 0 == s.GetSpanID() {
+		return ""
+	}
+	return s.GetTracePath() + ";" + spans.HexSpanID(s.GetSpanID())
+}
+
 // Import() returns a new Factory containing a span created somewhere
 // else.  If the traceID or spanID is invalid, then a 'nil' Factory and
 // an error are returned.  The usual reason to do this is so that you can
@@ -654,33 +1432,168 @@ func (s Span) Import(traceID string, spanID uint64) (spans.Factory, error) {
 	if nil != err {
 		return nil, err
 	}
-	sp := newSpan(ROSpan.(spans.ROSpan), s.ch)
+	sp := newSpan(ROSpan.(spans.ROSpan), s.ch, s.reg)
 	return sp, nil
 }
 
+// ImportFromPath() is like Import() but takes the canonical path to a
+// span, "projects/{projectID}/traces/{traceID}/spans/{spanID}" (where
+// spanID is in hexadecimal), or just "{traceID}/{spanID}".  The projectID
+// in the path must not be empty, but the returned Factory still uses the
+// project of the invoking Factory.  If any part of the path is malformed,
+// then a 'nil' Factory and an error identifying that part are returned.
+//
+func (s Span) ImportFromPath(path string) (spans.Factory, error) {
+	parts := strings.Split(path, "/")
+	switch len(parts) {
+	case 2:
+	case 6:
+		if "projects" != parts[0] || "traces" != parts[2] ||
+			"spans" != parts[4] {
+			return nil, fmt.Errorf("ImportFromPath(): Path (%s) not like"+
+				" projects/{project}/traces/{trace}/spans/{span}", path)
+		} else if "" == parts[1] {
+			return nil, fmt.Errorf(
+				"ImportFromPath(): Empty project ID in path (%s)", path)
+		}
+		parts = []string{parts[3], parts[5]}
+	default:
+		return nil, fmt.Errorf("ImportFromPath(): Path (%s) has %d parts"+
+			" not 2 (trace/span) nor 6 (projects/.../spans/span)",
+			path, len(parts))
+	}
+	traceID, hexSpanID := parts[0], parts[1]
+	if "" == hexSpanID || 16 < len(hexSpanID) {
+		return nil, fmt.Errorf("ImportFromPath(): Invalid span ID (%s)"+
+			" has length %d not 1..16", hexSpanID, len(hexSpanID))
+	}
+	spanID, err := strconv.ParseUint(hexSpanID, 16, 64)
+	if nil != err {
+		return nil, fmt.Errorf(
+			"ImportFromPath(): Invalid span ID (%s) not hex", hexSpanID)
+	}
+	return s.Import(traceID, spanID)
+}
+
 // ImportFromHeaders() returns a new Factory containing a span created
-// somewhere else based on the "X-Cloud-Trace-Context:" header.  If the
+// somewhere else based on the "X-Cloud-Trace-Context:" header (or the
+// header named by TraceHeader or Registrar.SetTraceHeader()).  If the
 // header does not contain a valid CloudContext value, then a valid but
 // empty Factory is returned.
 //
+// The sampling decision in the header's ";o=" option is honored: sub-spans
+// of a span imported with "o=0" are never registered and those imported
+// with "o=1" always are.  Without the option, SPAN_SAMPLE_RATE decides.
+//
 func (s Span) ImportFromHeaders(headers http.Header) spans.Factory {
+	cloudContext, opt := splitTraceOption(headers.Get(s.reg.traceHeader()))
+	headers = http.Header{spans.TraceHeader: {cloudContext}}
 	roSpan := s.ROSpan.ImportFromHeaders(headers)
-	sp := newSpan(roSpan.(spans.ROSpan), s.ch)
+	sp := newSpan(roSpan.(spans.ROSpan), s.ch, s.reg)
+	if 0 == sp.GetSpanID() {
+		return sp
+	}
+	switch opt {
+	case "0":
+		sp.unsampled = true
+	case "1":
+	default:
+		sp.unsampled = !s.reg.sample()
+	}
 	return sp
 }
 
+// splitTraceOption() splits a CloudContext header value like
+// "TRACE_ID/SPAN_ID;o=1" into the "TRACE_ID/SPAN_ID" part and the value
+// of the "o=" option ("" if it is missing).
+//
+func splitTraceOption(val string) (cloudContext, opt string) {
+	cloudContext = val
+	if i := strings.IndexByte(val, ';'); 0 <= i {
+		cloudContext = val[:i]
+		opt = strings.TrimPrefix(val[i+1:], "o=")
+		if opt == val[i+1:] { // Not an "o=" option
+			opt = ""
+		}
+	}
+	return
+}
+
+// headerValue() returns the contained span's CloudContext followed by the
+// ";o=" option carrying its sampling decision.
+//
+func (s *Span) headerValue() string {
+	if s.unsampled {
+		return s.GetCloudContext() + ";o=0"
+	}
+	return s.GetCloudContext() + ";o=1"
+}
+
+// SetHeader() sets the "X-Cloud-Trace-Context:" header (or the header
+// named by TraceHeader or Registrar.SetTraceHeader()) to carry the trace
+// context of the contained span, including its sampling decision, to
+// another service.  Does nothing if the Factory is empty.  Always returns
+// the calling Factory so further method calls can be chained.
+//
+func (s *Span) SetHeader(headers http.Header) spans.Factory {
+	if 0 != s.GetSpanID() {
+		headers.Set(s.reg.traceHeader(), s.headerValue())
+	}
+	return s
+}
+
+// ImportFromMetadata() is like ImportFromHeaders() but for a span created
+// in the gRPC client that sent the incoming metadata 'md'.  The trace
+// context is read from the lowercased name of the same header, such as
+// "x-cloud-trace-context", per the gRPC metadata convention.  The ";o="
+// sampling decision is honored just as for ImportFromHeaders().
+//
+func (s Span) ImportFromMetadata(md metadata.MD) spans.Factory {
+	name := s.reg.traceHeader()
+	headers := http.Header{}
+	if vals := md.Get(strings.ToLower(name)); 0 < len(vals) {
+		headers.Set(name, vals[0])
+	}
+	return s.ImportFromHeaders(headers)
+}
+
+// InjectIntoMetadata() is like SetHeader() but sets the trace context
+// (including the sampling decision) in outgoing gRPC metadata 'md' (using
+// the lowercased header name).  Does
+// nothing if the Factory is empty.  Always returns the calling Factory so
+// further method calls can be chained.
+//
+func (s *Span) InjectIntoMetadata(md metadata.MD) spans.Factory {
+	if 0 != s.GetSpanID() {
+		md.Set(strings.ToLower(s.reg.traceHeader()), s.headerValue())
+	}
+	return s
+}
+
 // NewTrace() returns a new Factory holding a new span, part of a new
 // trace.  Any span held in the invoking Factory is ignored.
 //
-func (s Span) NewTrace() spans.Factory {
-	ROSpan, err := s.ROSpan.Import(
-		NewTraceID(s.GetTraceID()), NewSpanID(s.GetSpanID()))
-	sp := newSpan(ROSpan.(spans.ROSpan), s.ch)
+// NewTrace() only reads the invoking Factory's span, under the same lock
+// that NewSubSpan() uses, so it is safe to call it on the same Factory from
+// multiple go routines, even while NewSubSpan() is also being called.
+//
+func (s *Span) NewTrace() spans.Factory {
+	if nil != s.mu {
+		s.mu.Lock()
+	}
+	ro := s.ROSpan
+	if nil != s.mu {
+		s.mu.Unlock()
+	}
+	ROSpan, err := ro.Import(
+		NewTraceID(ro.GetTraceID()), NewSpanID(ro.GetSpanID()))
+	sp := newSpan(ROSpan.(spans.ROSpan), s.ch, s.reg)
 	if nil != err {
 		lager.Fail().MMap("Impossibly got invalid trace/span ID", "err", err)
 		return sp
 	}
 	sp.start = time.Now()
+	sp.unsampled = !s.reg.sample()
 	return sp.initDetails()
 }
 
@@ -734,9 +1647,10 @@ func (s *Span) NewSubSpan() spans.Factory {
 	locked = false
 	s.mu.Unlock()
 
-	kid := newSpan(ro, s.ch)
+	kid := newSpan(ro, s.ch, s.reg)
 	kid.start = time.Now()
 	kid.parent = s
+	kid.unsampled = s.unsampled
 	kid.initDetails()
 	if !s.start.IsZero() {
 		kid.details.SameProcessAsParentSpan = true
@@ -744,6 +1658,24 @@ func (s *Span) NewSubSpan() spans.Factory {
 	return kid
 }
 
+// NewSubSpanRemote() is just like NewSubSpan() except that the new span is
+// never marked as being in the same process as its parent span.  Use it for
+// sub-spans that represent work handed off to something that is logically
+// separate from the parent's work (such as a shared worker pool that
+// processes requests from many callers) so the CloudTrace UI does not
+// present the work as having been done in-line by the parent.
+//
+// Sub-spans of an Import()ed span are never marked as being in the same
+// process, so NewSubSpan() is fine for those.
+//
+func (s *Span) NewSubSpanRemote() spans.Factory {
+	kid := s.NewSubSpan()
+	if sp, ok := kid.(*Span); ok {
+		sp.details.SameProcessAsParentSpan = false
+	}
+	return kid
+}
+
 // NewSpan() returns a new Factory holding a new span; either NewTrace() or
 // NewSubSpan(), depending on whether the invoking Factory is empty.
 //
@@ -754,6 +1686,20 @@ func (s *Span) NewSpan() spans.Factory {
 	return s.NewSubSpan()
 }
 
+// IsSampled() returns whether the contained span will be registered with
+// CloudTrace when it is Finish()ed.  This lets callers skip computing
+// costly attributes that would never be recorded.  Always returns 'false'
+// for an empty Factory.  Spans are sampled unless SPAN_SAMPLE_RATE [see
+// NewRegistrar()] caused their trace to not be chosen or they are part of a
+// trace imported with an "o=0" decision [see ImportFromHeaders()].
+//
+func (s *Span) IsSampled() bool {
+	if 0 == s.GetSpanID() {
+		return false
+	}
+	return !s.unsampled
+}
+
 // Sets the span kind to "SERVER".  Does nothing except log a failure
 // with a stack trace if the Factory is empty or Import()ed.  Always returns
 // the calling Factory so further method calls can be chained.
@@ -798,25 +1744,191 @@ func (s *Span) SetIsSubscriber() spans.Factory {
 	return s
 }
 
+// Attribute keys that CloudTrace recognizes for HTTP requests; used by
+// SetHTTPClient() and SetHTTPServer().
+const (
+	AttrHTTPMethod     = "/http/method"
+	AttrHTTPURL        = "/http/url"
+	AttrHTTPRoute      = "/http/route"
+	AttrHTTPStatusCode = "/http/status_code"
+)
+
+// SetHTTPClient() marks the contained span as a client span [see
+// SetIsClient()] for an outbound HTTP request and adds the standard
+// AttrHTTPMethod, AttrHTTPURL, and AttrHTTPStatusCode attributes.  If
+// 'status' is not a 2xx status, then it also sets the status code [see
+// SetHTTPStatus()].  Empty strings and a 0 'status' are not recorded.
+// Does nothing except log a failure with a stack trace if the Factory is
+// empty or Import()ed.  Always returns the calling Factory so further
+// method calls can be chained.
+//
+func (s *Span) SetHTTPClient(method, url string, status int) spans.Factory {
+	if s.logIfEmpty(true) {
+		return s
+	}
+	s.details.SpanKind = "CLIENT"
+	s.setHTTP(method, AttrHTTPURL, url, status)
+	return s
+}
+
+// SetHTTPServer() is like SetHTTPClient() but marks the contained span as
+// a server span [see SetIsServer()] for an inbound HTTP request and
+// records the matched 'route' (such as "/users/{id}") as AttrHTTPRoute.
+//
+func (s *Span) SetHTTPServer(method, route string, status int) spans.Factory {
+	if s.logIfEmpty(true) {
+		return s
+	}
+	s.details.SpanKind = "SERVER"
+	s.setHTTP(method, AttrHTTPRoute, route, status)
+	return s
+}
+
+// setHTTP() does the work shared by SetHTTPClient() and SetHTTPServer().
+//
+func (s *Span) setHTTP(method, pathKey, path string, status int) {
+	if "" != method {
+		s.addAttribute(AttrHTTPMethod, method, false)
+	}
+	if "" != path {
+		s.addAttribute(pathKey, path, false)
+	}
+	s.addAttribute(AttrHTTPStatusCode, status, true)
+	if 0 != status && (status < 200 || 300 <= status) {
+		s.setStatusCode(HTTPStatusToCode(status))
+	}
+}
+
+// AttrRetryCount is the attribute key used by SetRetryCount() and
+// IncRetryCount() to record how many times an operation was retried.
+const AttrRetryCount = "retry.count"
+
+// SetRetryCount() records 'n', the number of times that the operation
+// covered by the contained span was retried (not counting the first
+// attempt), as the AttrRetryCount attribute.  A 0 'n' is not recorded.
+//
+// Does nothing if the Factory is empty.  Logs a failure with a stack trace
+// if the Factory is Import()ed or already Finish()ed.  Always returns the
+// calling Factory so further method calls can be chained.
+//
+func (s *Span) SetRetryCount(n int) spans.Factory {
+	if 0 == s.GetSpanID() || s.logIfEmpty(true) {
+		return s
+	}
+	s.addAttribute(AttrRetryCount, n, true)
+	return s
+}
+
+// IncRetryCount() adds 1 to the AttrRetryCount attribute (which starts at
+// 0), so a retry loop can just call it before each retry, like:
+//
+//      for err = op(); retryable(err); err = op() {
+//          span.(*trace.Span).IncRetryCount()
+//      }
+//
+// Does nothing if the Factory is empty.  Logs a failure with a stack trace
+// if the Factory is Import()ed or already Finish()ed.  Always returns the
+// calling Factory so further method calls can be chained.
+//
+func (s *Span) IncRetryCount() spans.Factory {
+	if 0 == s.GetSpanID() || s.logIfEmpty(true) {
+		return s
+	}
+	defer s.lockAttrs()()
+	var n int64
+	if nil != s.details.Attributes {
+		n = s.details.Attributes.AttributeMap[AttrRetryCount].IntValue
+	}
+	s.putAttribute(AttrRetryCount, ct2.AttributeValue{IntValue: n + 1})
+	return s
+}
+
+// Attribute keys used by SetSource() to record a location in the code.
+const (
+	AttrCodeFilepath = "code.filepath"
+	AttrCodeLineno   = "code.lineno"
+	AttrCodeFunction = "code.function"
+)
+
+// SetSource() records the file path, line number, and (package-qualified)
+// function name of a caller as the AttrCodeFilepath, AttrCodeLineno, and
+// AttrCodeFunction attributes on the contained span.  A 'skip' of 0 records
+// the code that called SetSource(), 1 records its caller, etc.  This is
+// useful from helpers that create spans, so the span shows where it was
+// created from.
+//
+// Does nothing if the Factory is empty.  Logs a failure with a stack trace
+// if the Factory is Import()ed or already Finish()ed.  Always returns the
+// calling Factory so further method calls can be chained.
+//
+func (s *Span) SetSource(skip int) spans.Factory {
+	if 0 == s.GetSpanID() || s.logIfEmpty(true) {
+		return s
+	}
+	pc, file, line, ok := runtime.Caller(1 + skip)
+	if !ok {
+		return s
+	}
+	s.addAttribute(AttrCodeFilepath, file, false)
+	s.addAttribute(AttrCodeLineno, line, false)
+	if fn := runtime.FuncForPC(pc); nil != fn {
+		s.addAttribute(AttrCodeFunction, fn.Name(), false)
+	}
+	return s
+}
+
 // SetDisplayName() sets the display name on the contained span.  Does
 // nothing except log a failure with a stack trace if the Factory is
 // empty or Import()ed.  Always returns the calling Factory so further
 // method calls can be chained.
 //
+// If StripDisplayNameQuery is 'true', then any part of 'desc' starting
+// with a '?' is dropped.  A name longer than MaxDisplayNameBytes is then
+// truncated (without splitting a UTF-8 character) and its
+// TruncatedByteCount is set.  The first truncation for each span is logged.
+//
 func (s *Span) SetDisplayName(desc string) spans.Factory {
 	if !s.logIfEmpty(true) {
+		if StripDisplayNameQuery {
+			if i := strings.IndexByte(desc, '?'); 0 <= i {
+				desc = desc[:i]
+			}
+		}
 		if "" == desc {
 			s.details.DisplayName = nil
 		} else {
 			if nil == s.details.DisplayName {
 				s.details.DisplayName = &ct2.TruncatableString{}
 			}
-			s.details.DisplayName.Value = desc
+			name, cut := truncateUTF8(desc, MaxDisplayNameBytes)
+			s.details.DisplayName.Value = name
+			s.details.DisplayName.TruncatedByteCount = int64(cut)
+			if 0 < cut && !s.nameWarn {
+				s.nameWarn = true
+				lager.Warn().WithCaller(1).MMap(
+					"Span display name too long so truncated",
+					"name", name, "bytes", len(desc),
+					"max", MaxDisplayNameBytes)
+			}
 		}
 	}
 	return s
 }
 
+// truncateUTF8() returns 's' shortened to at most 'max' bytes, without
+// splitting a multi-byte UTF-8 character, and how many bytes were removed.
+//
+func truncateUTF8(s string, max int) (string, int) {
+	if len(s) <= max {
+		return s, 0
+	}
+	end := max
+	for 0 < end && !utf8.RuneStart(s[end]) {
+		end--
+	}
+	return s[:end], len(s) - end
+}
+
 // AddAttribute() adds an attribute key/value pair to the contained span.
 // Does nothing except log a failure with a stack trace if the Factory is
 // empty or Import()ed (even returning a 'nil' error).
@@ -827,6 +1939,9 @@ func (s *Span) SetDisplayName(desc string) spans.Factory {
 // 'key' is empty or 'val' is not one of the listed types, then an error
 // is returned and the attribute is not added.
 //
+// If the span already has MaxAttributes attributes and 'key' is not one of
+// them, then the attribute is dropped and counted (see MaxAttributes).
+//
 func (s *Span) AddAttribute(key string, val interface{}) error {
 	if s.logIfEmpty(true) {
 		return nil
@@ -870,13 +1985,79 @@ func (s *Span) addAttribute(key string, val interface{}, noZero bool) error {
 	default:
 		return fmt.Errorf("AddAttribute(): Invalid value type (%T)", val)
 	}
+	defer s.lockAttrs()()
+	s.putAttribute(key, av)
+	return nil
+}
+
+// lockAttrs() locks the span if Concurrent() was called and returns the
+// function to unlock it (which does nothing if no lock was taken).
+//
+func (s *Span) lockAttrs() func() {
+	if !s.safeAttr {
+		return func() {}
+	}
+	s.mu.Lock()
+	return s.mu.Unlock
+}
+
+// putAttribute() stores an attribute value, enforcing MaxAttributes (or
+// SPAN_MAX_ATTRIBUTES).  The caller must hold the lock from lockAttrs().
+//
+func (s *Span) putAttribute(key string, av ct2.AttributeValue) {
+	limit := s.reg.maxAttributes()
 	if nil == s.details.Attributes {
 		s.details.Attributes = &ct2.Attributes{
 			AttributeMap: make(map[string]ct2.AttributeValue),
 		}
 	}
-	s.details.Attributes.AttributeMap[key] = av
-	return nil
+	attrs := s.details.Attributes
+	if _, ok := attrs.AttributeMap[key]; !ok &&
+		limit <= len(attrs.AttributeMap) {
+		attrs.DroppedAttributesCount++
+		if 1 == attrs.DroppedAttributesCount {
+			name := ""
+			if nil != s.details.DisplayName {
+				name = s.details.DisplayName.Value
+			}
+			lager.Warn().MMap(
+				"Too many attributes on span; dropping further ones",
+				"span", name, "key", key, "limit", limit)
+		}
+		return
+	}
+	attrs.AttributeMap[key] = av
+}
+
+// Concurrent() marks the contained span as one that will have attributes
+// added to it [via AddAttribute() or AddPairs()] from multiple goroutines,
+// so those additions will be done while holding a lock.  It must be called
+// before the span is shared with other goroutines.  Spans not marked this
+// way avoid the overhead of locking.  Sub-spans are not marked.
+//
+// Does nothing except log a failure with a stack trace if the Factory is
+// empty or Import()ed.  Always returns the calling Factory so further
+// method calls can be chained.
+//
+func (s *Span) Concurrent() spans.Factory {
+	if s.logIfEmpty(true) {
+		return s
+	}
+	s.safeAttr = true
+	return s
+}
+
+// pairKey() converts a key passed to AddPairs() into a string.  Keys can
+// be a 'string' or any value with a String() method.
+//
+func pairKey(ix interface{}) (string, bool) {
+	switch key := ix.(type) {
+	case string:
+		return key, true
+	case Stringer:
+		return key.String(), true
+	}
+	return "", false
 }
 
 // AddPairs() takes a list of attribute key/value pairs.  For each pair,
@@ -888,6 +2069,9 @@ func (s *Span) addAttribute(key string, val interface{}, noZero bool) error {
 // rather than either logging an error or adding them only to have the value
 // show up as "undefined".
 //
+// Each key must be a 'string' or a value with a String() method (such as a
+// custom 'type AttrKey string' that implements Stringer).
+//
 // Does nothing except log a single failure with a stack trace if the
 // Factory is empty or Import()ed.
 //
@@ -895,13 +2079,20 @@ func (s *Span) AddPairs(pairs ...interface{}) spans.Factory {
 	if s.logIfEmpty(true) {
 		return s
 	}
-	log := s.getFailLager().WithCaller(1)
+	s.addPairs(s.getFailLager().WithCaller(1), pairs)
+	return s
+}
+
+// addPairs() does the work of AddPairs() and FinishWith(), logging any
+// problems to 'log'.
+//
+func (s *Span) addPairs(log lager.Lager, pairs []interface{}) {
 	for i := 0; i < len(pairs); i += 2 {
 		ix := pairs[i]
 		if len(pairs) <= i+1 {
 			log.MMap("Ignoring unpaired last arg to trace.Span AddPairs()",
 				"arg", ix)
-		} else if key, ok := ix.(string); !ok {
+		} else if key, ok := pairKey(ix); !ok {
 			log.MMap("Non-string key passed to trace.Span AddPairs()",
 				"type", fmt.Sprintf("%T", ix), "key", ix, "arg index", i)
 		} else if err := s.addAttribute(key, pairs[i+1], true); nil != err {
@@ -909,13 +2100,84 @@ func (s *Span) AddPairs(pairs ...interface{}) spans.Factory {
 				"key", key, "val", pairs[i+1], "error", err)
 		}
 	}
+}
+
+// AddAttributes() is like AddPairs() but takes the attributes as a map of
+// keys to values, such as when the data is already in that form.  Zero
+// values are ignored and problems with any value are logged the same way.
+// The attributes are added in order by key so that, if the span reaches
+// its limit [see MaxAttributes], the same ones are always dropped.  Always
+// returns the calling Factory so further method calls can be chained.
+//
+// Does nothing except log a single failure with a stack trace if the
+// Factory is empty or Import()ed.
+//
+func (s *Span) AddAttributes(attrs map[string]interface{}) spans.Factory {
+	if s.logIfEmpty(true) {
+		return s
+	}
+	log := s.getFailLager().WithCaller(1)
+	keys := make([]string, 0, len(attrs))
+	for key := range attrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		val := attrs[key]
+		if err := s.addAttribute(key, val, true); nil != err {
+			log.MMap("Error adding attribute to Span",
+				"key", key, "val", val, "error", err)
+		}
+	}
 	return s
 }
 
+// HTTPStatusToCode() converts an HTTP status code into the closest
+// canonical status code from google.golang.org/genproto/googleapis/rpc/code.
+//
+func HTTPStatusToCode(status int) int64 {
+	switch status {
+	case 400:
+		return int64(rpc.Code_INVALID_ARGUMENT)
+	case 401:
+		return int64(rpc.Code_UNAUTHENTICATED)
+	case 403:
+		return int64(rpc.Code_PERMISSION_DENIED)
+	case 404:
+		return int64(rpc.Code_NOT_FOUND)
+	case 409:
+		return int64(rpc.Code_ABORTED)
+	case 412:
+		return int64(rpc.Code_FAILED_PRECONDITION)
+	case 429:
+		return int64(rpc.Code_RESOURCE_EXHAUSTED)
+	case 499:
+		return int64(rpc.Code_CANCELLED)
+	case 501:
+		return int64(rpc.Code_UNIMPLEMENTED)
+	case 503:
+		return int64(rpc.Code_UNAVAILABLE)
+	case 504:
+		return int64(rpc.Code_DEADLINE_EXCEEDED)
+	}
+	switch {
+	case 100 <= status && status < 400:
+		return int64(rpc.Code_OK)
+	case 400 <= status && status < 500:
+		return int64(rpc.Code_FAILED_PRECONDITION)
+	case 500 <= status && status < 600:
+		return int64(rpc.Code_INTERNAL)
+	}
+	return int64(rpc.Code_UNKNOWN)
+}
+
+var httpCodeWarnOnce sync.Once
+
 // SetStatusCode() sets the status code on the contained span.
 // 'code' is expected to be a value from
-// google.golang.org/genproto/googleapis/rpc/code but this is not
-// verified.  HTTP status codes are also understood by the library.
+// google.golang.org/genproto/googleapis/rpc/code (0..16).  A value in the
+// HTTP status range (100..599) is translated via HTTPStatusToCode() and a
+// warning is logged (only once) suggesting SetHTTPStatus() be used instead.
 // Does nothing except log a failure with a stack trace if the Factory
 // is empty or Import()ed.  Always returns the calling Factory so further
 // method calls can be chained.
@@ -924,6 +2186,30 @@ func (s *Span) SetStatusCode(code int64) spans.Factory {
 	if s.logIfEmpty(true) {
 		return s
 	}
+	if 100 <= code && code < 600 {
+		httpCodeWarnOnce.Do(func() {
+			lager.Warn().WithCaller(1).MMap(
+				"HTTP status passed to SetStatusCode(); use SetHTTPStatus()",
+				"status", code)
+		})
+		code = HTTPStatusToCode(int(code))
+	}
+	return s.setStatusCode(code)
+}
+
+// SetHTTPStatus() sets the status code on the contained span based on
+// an HTTP status code [see HTTPStatusToCode()].  Does nothing except log a
+// failure with a stack trace if the Factory is empty or Import()ed.  Always
+// returns the calling Factory so further method calls can be chained.
+//
+func (s *Span) SetHTTPStatus(status int) spans.Factory {
+	if s.logIfEmpty(true) {
+		return s
+	}
+	return s.setStatusCode(HTTPStatusToCode(status))
+}
+
+func (s *Span) setStatusCode(code int64) spans.Factory {
 	if nil == s.details.Status {
 		s.details.Status = &ct2.Status{}
 	}
@@ -960,17 +2246,142 @@ func (s *Span) Finish() time.Duration {
 	if s.logIfEmpty(true) {
 		return time.Duration(0)
 	}
+	return s.finishAt(time.Now())
+}
+
+// FinishWith() is the same as calling AddPairs(pairs...) and then
+// Finish(), but only checks once whether the Factory is empty.  Useful
+// for attaching final attributes in a deferred call, such as:
+//
+//      defer span.FinishWith("status", code, "bytes", written)
+//
+// Note that, as with any 'defer', the arguments are evaluated when the
+// 'defer' statement runs, so wrap it in a closure to record values that
+// are only computed later.  Pairs with zero values are ignored just like
+// with AddPairs().
+//
+func (s *Span) FinishWith(pairs ...interface{}) time.Duration {
+	if s.logIfEmpty(true) {
+		return time.Duration(0)
+	}
+	s.addPairs(s.getFailLager().WithCaller(1), pairs)
+	return s.finishAt(time.Now())
+}
+
+// FinishWithError() is the same as Finish() except that, if 'err' is not
+// 'nil', it first sets the status code [see ErrorToCode()] and sets the
+// status message to 'err.Error()'.  Convenient when used like:
+//
+//      defer func() { span.FinishWithError(err) }()
+//
+// A non-nil 'err' (and so a non-OK status) is also logged via lager.Warn(),
+// which happens at most once per span since a span can only be finished
+// once.
+//
+func (s *Span) FinishWithError(err error) time.Duration {
+	if s.logIfEmpty(true) {
+		return time.Duration(0)
+	}
+	if nil != err {
+		code := ErrorToCode(err)
+		s.setStatusCode(code)
+		s.SetStatusMessage(err.Error())
+		name := ""
+		if nil != s.details.DisplayName {
+			name = s.details.DisplayName.Value
+		}
+		lager.Warn().WithCaller(1).MMap("Span finished with error",
+			"span", name, "code", code, "error", err.Error())
+	}
+	return s.finishAt(time.Now())
+}
+
+// ErrorToCode() returns the canonical status code (from
+// "google.golang.org/genproto/googleapis/rpc/code") to record for a
+// non-nil error.  If 'err' (or an error it wraps) has a GRPCStatus()
+// method, then that gRPC code is used.  If it has an 'HTTPStatus() int'
+// method or is a *googleapi.Error, then the HTTP status is translated via
+// HTTPStatusToCode().  Otherwise (or if the found code would be OK),
+// INTERNAL is returned.
+//
+func ErrorToCode(err error) int64 {
+	var grpcErr interface{ GRPCStatus() *status.Status }
+	var httpErr interface{ HTTPStatus() int }
+	code := int64(rpc.Code_OK)
+	if errors.As(err, &grpcErr) {
+		code = int64(grpcErr.GRPCStatus().Code())
+	} else if errors.As(err, &httpErr) {
+		code = HTTPStatusToCode(httpErr.HTTPStatus())
+	} else if httpStatus := conn.ErrorCode(err); 0 != httpStatus {
+		code = HTTPStatusToCode(httpStatus)
+	}
+	if int64(rpc.Code_OK) == code {
+		code = int64(rpc.Code_INTERNAL)
+	}
+	return code
+}
+
+// SetStartTime() changes the recorded start time of the contained span.
+// This is useful when recording work whose true timing is only known after
+// the fact (such as when importing batch-processed events).  Does nothing
+// except log a failure with a stack trace if the Factory is empty or
+// Import()ed or if 'start' is a zero time.  Always returns the calling
+// Factory so further method calls can be chained.
+//
+func (s *Span) SetStartTime(start time.Time) spans.Factory {
+	if s.logIfEmpty(true) {
+		return s
+	} else if start.IsZero() {
+		s.getFailLager().WithStack(1, -1).MMap(
+			"SetStartTime() passed zero time")
+		return s
+	}
+	s.start = start
+	s.details.StartTime = spanTime(start)
+	return s
+}
+
+// FinishAt() is like Finish() except that the span's end time is set to
+// 'end' rather than to the current time.  If 'end' is before the span's
+// start time, then a failure with a stack trace is logged, the span is
+// not Finish()ed, and a 0 duration is returned.
+//
+func (s *Span) FinishAt(end time.Time) time.Duration {
+	if s.logIfEmpty(true) {
+		return time.Duration(0)
+	} else if end.Before(s.start) {
+		s.getFailLager().WithStack(1, -1).MMap(
+			"FinishAt() passed time before start of span",
+			"start", TimeAsString(s.start), "end", TimeAsString(end))
+		return time.Duration(0)
+	}
+	return s.finishAt(end)
+}
+
+// finishAt() does the work of Finish() and FinishAt().
+//
+func (s *Span) finishAt(end time.Time) time.Duration {
 	if nil == s.details.DisplayName {
 		s.SetDisplayName(os.Args[0])
 	}
 	s.mu.Lock() // Prevent a race with NewSubSpan()
-	s.end = time.Now()
+	s.end = end
 	s.mu.Unlock()
-	s.details.EndTime = TimeAsString(s.end)
+	s.details.EndTime = spanTime(s.end)
+	if s.unsampled {
+		if onDrop := s.reg.dropHook(); nil != onDrop {
+			onDrop(*s, "unsampled")
+		}
+		return s.end.Sub(s.start)
+	}
+	s.enqueued = time.Now()
 	select {
 	case s.ch <- *s:
 	default:
-		spanDropped()
+		spanDropped(s.reg.metricDomain())
+		if onDrop := s.reg.dropHook(); nil != onDrop {
+			onDrop(*s, "queue_full")
+		}
 	}
 	return s.end.Sub(s.start)
 }
@@ -19,27 +19,73 @@ var spanCreateSeconds = prometheus.NewHistogramVec(
 		Help:    "Seconds it took to register a span in GCP",
 		Buckets: buckets,
 	},
-	[]string{"result"},
+	[]string{"project_id", "trigger", "result"},
 )
 
-var spansDropped = prometheus.NewCounter(
+var spanQueueSeconds = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "gcpapi", Subsystem: "span", Name: "queue_wait_seconds",
+		Help:    "Seconds a finished span waited in the queue to be batched",
+		Buckets: buckets,
+	},
+	[]string{"domain"},
+)
+
+var spansDropped = prometheus.NewCounterVec(
 	prometheus.CounterOpts{
 		Namespace: "gcpapi", Subsystem: "span", Name: "dropped_total",
 		Help: "Number of spans that were not registered due to backlog",
 	},
+	[]string{"domain"},
+)
+
+var spansInvalid = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "gcpapi", Subsystem: "span", Name: "invalid_total",
+		Help: "Number of spans not sent to GCP because they were invalid",
+	},
+	[]string{"domain", "reason"},
 )
 
 func init() {
 	prometheus.MustRegister(spanCreateSeconds)
+	prometheus.MustRegister(spansInvalid)
+	prometheus.MustRegister(spanQueueSeconds)
+	prometheus.MustRegister(spansDropped)
 	metric.MustRegister(nil) // For metric.NewCapacityUsage()
 }
 
-func spanCreated(start time.Time, result string) {
-	spanCreateSeconds.WithLabelValues(result).Observe(
+// spanCreated() records how long a BatchWrite took.  'trigger' is what
+// caused the batch to be written: "size", "bytes", "timeout", "flush", or
+// "halt".  'result' is from writeResult(): "ok", "deadline", "canceled",
+// "transport", or "fail".
+//
+func spanCreated(start time.Time, project, trigger, result string) {
+	spanCreateSeconds.WithLabelValues(project, trigger, result).Observe(
 		float64(time.Now().Sub(start)) / float64(time.Second),
 	)
 }
 
-func spanDropped() {
-	spansDropped.Add(1)
+// spanQueued() records how long a span sat in the queue since it was
+// Finish()ed.  'domain' is the Registrar's metric prefix [see
+// WithMetricPrefix()], which defaults to the value of LAGER_SPAN_PREFIX.
+//
+func spanQueued(domain string, enqueued time.Time) {
+	spanQueueSeconds.WithLabelValues(domain).Observe(
+		float64(time.Now().Sub(enqueued)) / float64(time.Second),
+	)
+}
+
+// spanDropped() counts a span that could not be queued.  See spanQueued()
+// for 'domain'.
+//
+func spanDropped(domain string) {
+	spansDropped.WithLabelValues(domain).Add(1)
+}
+
+// spanInvalid() counts a span that was dropped for being invalid.  See
+// spanQueued() for 'domain' and invalidReason() for 'reason'.
+//
+func spanInvalid(domain, reason string) {
+	spansInvalid.WithLabelValues(domain, reason).Add(1)
 }